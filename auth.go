@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type contextKey string
+
+const clientNameContextKey contextKey = "client-name"
+
+// AuthTokenStore ...
+// Named bearer tokens, from the CMD_BRIDGE_TOKENS environment variable
+// and / or from a token file. The token file is re-read when it changes,
+// so tokens can be rotated without restarting the server. If the token file
+// is removed or emptied its tokens are revoked, if it becomes invalid
+// (or can't be read) the previously loaded tokens are used.
+// Both use the same format: name:token pairs, separated by commas or new lines.
+type AuthTokenStore struct {
+	mu            sync.Mutex
+	envTokens     map[string]string
+	filePath      string
+	fileModTime   time.Time
+	fileSize      int64
+	fileTokens    map[string]string
+	isFileMissing bool
+	isAuthEnabled bool
+}
+
+var serverAuthTokenStore = &AuthTokenStore{}
+
+// NewAuthTokenStore ...
+// Authentication is enabled if tokenFilePath or envTokens is specified,
+// an error is returned if any of them is invalid.
+func NewAuthTokenStore(tokenFilePath, envTokens string) (*AuthTokenStore, error) {
+	store := &AuthTokenStore{
+		filePath:      tokenFilePath,
+		isAuthEnabled: tokenFilePath != "" || envTokens != "",
+	}
+
+	tokens, err := parseAuthTokens(envTokens)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CMD_BRIDGE_TOKENS: %s", err)
+	}
+	store.envTokens = tokens
+
+	if tokenFilePath != "" {
+		if err := store.reloadTokenFileIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// IsAuthEnabled ...
+func (store *AuthTokenStore) IsAuthEnabled() bool {
+	return store.isAuthEnabled
+}
+
+// Authenticate ...
+// Returns the name of the token, if it's a valid one.
+func (store *AuthTokenStore) Authenticate(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+
+	if store.filePath != "" {
+		if err := store.reloadTokenFileIfChanged(); err != nil {
+			log.Println(" [!] Failed to reload token file, using the previously loaded tokens:", err)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	clientName := ""
+	for _, tokens := range []map[string]string{store.envTokens, store.fileTokens} {
+		for aToken, aName := range tokens {
+			// check every token, the time it takes shouldn't depend on which one matches
+			if subtle.ConstantTimeCompare([]byte(aToken), []byte(token)) == 1 {
+				clientName = aName
+			}
+		}
+	}
+	return clientName, clientName != ""
+}
+
+func (store *AuthTokenStore) reloadTokenFileIfChanged() error {
+	fileInfo, err := os.Stat(store.filePath)
+	if os.IsNotExist(err) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if store.fileTokens == nil {
+			// on startup the token file has to exist
+			return fmt.Errorf("Failed to read token file: %s", err)
+		}
+		if !store.isFileMissing {
+			log.Printf(" [!] Token file removed, its tokens are revoked: %s", store.filePath)
+			store.fileTokens = map[string]string{}
+			store.fileModTime = time.Time{}
+			store.fileSize = 0
+			store.isFileMissing = true
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read token file: %s", err)
+	}
+
+	store.mu.Lock()
+	isChanged := store.fileTokens == nil || store.isFileMissing ||
+		!fileInfo.ModTime().Equal(store.fileModTime) || fileInfo.Size() != store.fileSize
+	store.mu.Unlock()
+	if !isChanged {
+		return nil
+	}
+
+	fileContent, err := readAuthTokenFile(store.filePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read token file: %s", err)
+	}
+	tokens, err := parseAuthTokens(fileContent)
+	if err != nil {
+		return fmt.Errorf("Invalid token file (%s): %s", store.filePath, err)
+	}
+
+	store.mu.Lock()
+	store.fileTokens = tokens
+	store.fileModTime = fileInfo.ModTime()
+	store.fileSize = fileInfo.Size()
+	store.isFileMissing = false
+	store.mu.Unlock()
+
+	log.Printf(" (i) Loaded %d token(s) from: %s", len(tokens), store.filePath)
+	return nil
+}
+
+func readAuthTokenFile(pth string) (string, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(" [!] Failed to close token file:", err)
+		}
+	}()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(lines, ","), nil
+}
+
+// parseAuthTokens parses comma separated name:token pairs, into a token -> name map
+func parseAuthTokens(s string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, aPair := range strings.Split(s, ",") {
+		aPair = strings.TrimSpace(aPair)
+		if aPair == "" {
+			continue
+		}
+		splits := strings.SplitN(aPair, ":", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[0]) == "" || strings.TrimSpace(splits[1]) == "" {
+			return nil, fmt.Errorf("invalid token definition, expected name:token, got an item with %d character(s)", len(aPair))
+		}
+		name := strings.TrimSpace(splits[0])
+		token := strings.TrimSpace(splits[1])
+		if _, isDuplicate := tokens[token]; isDuplicate {
+			return nil, fmt.Errorf("the same token is defined more than once (name: %s)", name)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+func bearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if len(authHeader) > len("Bearer ") && strings.EqualFold(authHeader[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authHeader[len("Bearer "):])
+	}
+	return ""
+}
+
+// requireAuth wraps the handler, requests without a valid bearer token
+// are rejected with 401, and never reach the handler
+func requireAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !serverAuthTokenStore.IsAuthEnabled() {
+			// the client might be identified by its (verified) certificate
+			if certName := clientCertificateName(r); certName != "" {
+				r = r.WithContext(context.WithValue(r.Context(), clientNameContextKey, "cert:"+certName))
+			}
+			handler(w, r)
+			return
+		}
+
+		clientName, isValid := serverAuthTokenStore.Authenticate(bearerToken(r))
+		if !isValid {
+			log.Printf(" [!] Unauthorized request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+			serverMetrics.CountAuthFailure()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cmd-bridge"`)
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), clientNameContextKey, clientName)))
+	}
+}
+
+// isAdminClient - the admin_clients can access the jobs of every client
+func isAdminClient(clientName string) bool {
+	if clientName == "" {
+		return false
+	}
+	for _, aPattern := range configServer.AdminClients {
+		if matchWildcard(aPattern, clientName) {
+			return true
+		}
+	}
+	return false
+}
+
+// isJobAccessible - a job can only be accessed by the client which started it, or by an admin client.
+// Without authentication every client is anonymous, every anonymous job is accessible.
+func isJobAccessible(r *http.Request, jobClientName string) bool {
+	clientName := requestClientName(r)
+	return jobClientName == clientName || isAdminClient(clientName)
+}
+
+// requestClientName returns the name of the authenticated client:
+// the token's name, or the common name of the client certificate if only TLS client authentication is used.
+// Empty if the client is not identified.
+func requestClientName(r *http.Request) string {
+	clientName, ok := r.Context().Value(clientNameContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return clientName
+}
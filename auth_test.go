@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsJobAccessible(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+	configServer.AdminClients = []string{"admin-*"}
+
+	for _, tc := range []struct {
+		requestClient string
+		jobClient     string
+		want          bool
+	}{
+		{requestClient: "ci", jobClient: "ci", want: true},
+		{requestClient: "ci", jobClient: "deploy", want: false},
+		{requestClient: "ci", jobClient: "", want: false},
+		{requestClient: "", jobClient: "ci", want: false},
+		{requestClient: "", jobClient: "", want: true},
+		{requestClient: "admin-alice", jobClient: "ci", want: true},
+		{requestClient: "admin", jobClient: "ci", want: false},
+	} {
+		r := httptest.NewRequest("GET", "/jobs/id", nil)
+		if tc.requestClient != "" {
+			r = r.WithContext(context.WithValue(r.Context(), clientNameContextKey, tc.requestClient))
+		}
+		if got := isJobAccessible(r, tc.jobClient); got != tc.want {
+			t.Errorf("client %q, job of %q: got %v, want %v", tc.requestClient, tc.jobClient, got, tc.want)
+		}
+	}
+}
+
+func TestAuthTokenStoreTokenFileReload(t *testing.T) {
+	tokenFilePath := filepath.Join(t.TempDir(), "tokens")
+	var store *AuthTokenStore
+	writeTokenFile := func(content string) {
+		if err := ioutil.WriteFile(tokenFilePath, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write token file: %s", err)
+		}
+	}
+	checkAuth := func(step, token string, wantValid bool) {
+		if _, isValid := store.Authenticate(token); isValid != wantValid {
+			t.Errorf("%s: token %q valid: %v, want: %v", step, token, isValid, wantValid)
+		}
+	}
+
+	if _, err := NewAuthTokenStore(tokenFilePath, ""); err == nil {
+		t.Fatal("A missing token file should be an error on startup")
+	}
+
+	writeTokenFile("ci:secret1\n")
+	store, err := NewAuthTokenStore(tokenFilePath, "admin:secret2")
+	if err != nil {
+		t.Fatalf("Failed to create token store: %s", err)
+	}
+	checkAuth("loaded", "secret1", true)
+
+	writeTokenFile("")
+	checkAuth("emptied", "secret1", false)
+	checkAuth("emptied", "secret2", true)
+
+	writeTokenFile("ci:secret1\n")
+	checkAuth("restored", "secret1", true)
+
+	if err := os.Remove(tokenFilePath); err != nil {
+		t.Fatalf("Failed to remove token file: %s", err)
+	}
+	checkAuth("removed", "secret1", false)
+	checkAuth("removed", "secret2", true)
+
+	writeTokenFile("ci:secret3\n")
+	checkAuth("re-created", "secret3", true)
+
+	writeTokenFile("invalid line\n")
+	checkAuth("invalid", "secret3", true)
+}
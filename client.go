@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// configClientAuthToken - bearer token sent to the server, if specified
+var configClientAuthToken = ""
+
+// readClientAuthToken returns the token from the CMD_BRIDGE_TOKEN environment variable,
+// or if it's not set, from the token file (the whole file's content is the token)
+func readClientAuthToken(tokenFilePath string) (string, error) {
+	if token := os.Getenv("CMD_BRIDGE_TOKEN"); token != "" {
+		return token, nil
+	}
+	if tokenFilePath == "" {
+		return "", nil
+	}
+	tokenBytes, err := ioutil.ReadFile(tokenFilePath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read token file: %s", err)
+	}
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
+// newServerRequest creates a request to the cmd-bridge server's path (e.g. /cmd),
+// with the auth token, if one is specified
+func newServerRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, configServerURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if configClientAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+configClientAuthToken)
+	}
+	return req, nil
+}
+
+// jobSignalForwarder forwards the SIGINT / SIGTERM signals received by the client
+// to the remote job, so the command can be interrupted the same way
+// a local command could be.
+// Signals received before the job's ID is known are forwarded once it's set.
+type jobSignalForwarder struct {
+	mu             sync.Mutex
+	jobID          string
+	pendingSignals []os.Signal
+	signals        chan os.Signal
+	stopChan       chan struct{}
+}
+
+func newJobSignalForwarder() *jobSignalForwarder {
+	f := &jobSignalForwarder{
+		signals:  make(chan os.Signal, 4),
+		stopChan: make(chan struct{}),
+	}
+	signal.Notify(f.signals, syscall.SIGINT, syscall.SIGTERM)
+	go f.loop()
+	return f
+}
+
+func (f *jobSignalForwarder) SetJobID(jobID string) {
+	f.mu.Lock()
+	f.jobID = jobID
+	pendingSignals := f.pendingSignals
+	f.pendingSignals = nil
+	f.mu.Unlock()
+
+	for _, sig := range pendingSignals {
+		f.forward(jobID, sig)
+	}
+}
+
+func (f *jobSignalForwarder) Stop() {
+	signal.Stop(f.signals)
+	close(f.stopChan)
+}
+
+func (f *jobSignalForwarder) loop() {
+	for {
+		select {
+		case sig := <-f.signals:
+			f.mu.Lock()
+			jobID := f.jobID
+			if jobID == "" {
+				f.pendingSignals = append(f.pendingSignals, sig)
+			}
+			f.mu.Unlock()
+
+			if jobID != "" {
+				f.forward(jobID, sig)
+			}
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+func (f *jobSignalForwarder) forward(jobID string, sig os.Signal) {
+	sysSig, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+	vLogln("Forwarding signal to job: ", SignalName(sysSig))
+	if err := sendCancelToServer(jobID, sysSig); err != nil {
+		log.Println(" [!] Failed to forward signal to the cmd-bridge server:", err)
+	}
+}
+
+func sendCancelToServer(jobID string, sig syscall.Signal) error {
+	req, err := newServerRequest("POST", fmt.Sprintf("/jobs/%s/cancel?signal=%s", jobID, SignalName(sig)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := serverHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Println(" [!] Failed to close resp.Body:", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		respBodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Cancel failed (%d): %s", resp.StatusCode, string(respBodyBytes))
+	}
+	return nil
+}
+
+// sendStdinToServer streams stdinReader into the job's stdin, until EOF
+func sendStdinToServer(jobID string, stdinReader io.Reader) error {
+	// wrapping the reader hides its type, so the request body is streamed (chunked), even for a file
+	req, err := newServerRequest("POST", fmt.Sprintf("/jobs/%s/stdin", jobID), ioutil.NopCloser(stdinReader))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := serverHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Println(" [!] Failed to close resp.Body:", err)
+		}
+	}()
+
+	respBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Stdin upload failed (%d): %s", resp.StatusCode, string(respBodyBytes))
+	}
+	vLogln("Stdin sent: ", string(respBodyBytes))
+	return nil
+}
+
+// startTerminalResizeForwarding sends the local terminal's (stdout) size to the job's pty
+// every time it changes (SIGWINCH), until the returned func is called
+func startTerminalResizeForwarding(jobID string) func() {
+	resizeSignals := make(chan os.Signal, 1)
+	stopChan := make(chan struct{})
+	signal.Notify(resizeSignals, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-resizeSignals:
+				size, err := getTerminalSize(os.Stdout)
+				if err != nil {
+					vLogln("Failed to get terminal size:", err)
+					continue
+				}
+				if err := sendResizeToServer(jobID, size); err != nil {
+					vLogln("Failed to send terminal size to the cmd-bridge server:", err)
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(resizeSignals)
+		close(stopChan)
+	}
+}
+
+func sendResizeToServer(jobID string, size TerminalSizeModel) error {
+	sizeBytes, err := json.Marshal(size)
+	if err != nil {
+		return err
+	}
+	req, err := newServerRequest("POST", fmt.Sprintf("/jobs/%s/resize", jobID), bytes.NewReader(sizeBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := serverHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Println(" [!] Failed to close resp.Body:", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		respBodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Resize failed (%d): %s", resp.StatusCode, string(respBodyBytes))
+	}
+	return nil
+}
+
+// logPolicyDenial prints why the server denied the command
+func logPolicyDenial(denial *PolicyDenialModel) {
+	log.Println("The cmd-bridge server denied the command:", denial.Reason)
+	if denial.RequiredFlag != "" {
+		log.Printf("The command is allowed with: -policy-flag %s", denial.RequiredFlag)
+	}
+}
+
+// listJobsFromServer prints the server's jobs matching the query (GET /jobs filters),
+// as a table, or as the server's JSON if isJSON is true
+func listJobsFromServer(query url.Values, isJSON bool) error {
+	req, err := newServerRequest("GET", "/jobs?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := serverHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Println(" [!] Failed to close resp.Body:", err)
+		}
+	}()
+
+	respBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var respModel ResponseModel
+		if err := json.Unmarshal(respBodyBytes, &respModel); err == nil && respModel.Msg != "" {
+			return fmt.Errorf("Failed to list jobs (%d): %s", resp.StatusCode, respModel.Msg)
+		}
+		return fmt.Errorf("Failed to list jobs (%d): %s", resp.StatusCode, string(respBodyBytes))
+	}
+	if isJSON {
+		_, err := os.Stdout.Write(respBodyBytes)
+		return err
+	}
+
+	var jobList JobListModel
+	if err := json.Unmarshal(respBodyBytes, &jobList); err != nil {
+		return fmt.Errorf("Failed to decode the job list: %s", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "ID\tSTATUS\tEXIT\tCREATED\tDURATION\tCLIENT\tCOMMAND"); err != nil {
+		return err
+	}
+	for _, aRecord := range jobList.Jobs {
+		exitCode := "-"
+		if aRecord.FinishedAt != nil {
+			exitCode = strconv.Itoa(aRecord.ExitCode)
+		}
+		duration := "-"
+		if aRecord.FinishedAt != nil && aRecord.StartedAt != nil {
+			duration = (time.Duration(aRecord.DurationSec * float64(time.Second))).Round(time.Millisecond).String()
+		}
+		client := aRecord.Client
+		if client == "" {
+			client = "-"
+		}
+		command := aRecord.Command
+		if len(aRecord.Args) > 0 {
+			command = fmt.Sprintf("%q", aRecord.Args)
+		}
+		command = strings.Replace(command, "\n", " ", -1)
+		if runes := []rune(command); len(runes) > 60 {
+			command = string(runes[:57]) + "..."
+		}
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", aRecord.ID, jobRecordStatusText(aRecord), exitCode,
+			aRecord.CreatedAt.Local().Format("2006-01-02 15:04:05"), duration, client, command); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// jobRecordStatusText - the status, with the reason of the termination (if any)
+func jobRecordStatusText(record JobRecordModel) string {
+	switch {
+	case record.Cancelled:
+		return record.Status + " (cancelled)"
+	case record.TimedOut:
+		return record.Status + " (timed out)"
+	case record.LimitExceeded != "":
+		return record.Status + " (" + record.LimitExceeded + " limit)"
+	case record.Signal != "":
+		return record.Status + " (" + record.Signal + ")"
+	}
+	return record.Status
+}
@@ -20,25 +20,86 @@ type EnvironmentKeyValue struct {
 
 // CommandModel ...
 type CommandModel struct {
-	Command          string                `json:"command"`
-	WorkingDirectory string                `json:"working_directory"`
-	LogFilePath      string                `json:"log_file_path"`
-	Environments     []EnvironmentKeyValue `json:"environments"`
+	Command string `json:"command"`
+	// Args - if specified the program (the first item) is run directly with these exact arguments,
+	// without a shell, instead of Command
+	Args []string `json:"args,omitempty"`
+	// Shell - the shell (path, or only its name) to run Command with, it has to be allowed by the server.
+	// Default: the server's default shell
+	Shell string `json:"shell,omitempty"`
+	// Login - whether the shell is a login shell, default: the server's login_shell setting
+	Login            *bool  `json:"login,omitempty"`
+	WorkingDirectory string `json:"working_directory"`
+	LogFilePath      string `json:"log_file_path"`
+	// LogFormat of the log file: raw (default) or ndjson
+	LogFormat    string                `json:"log_format,omitempty"`
+	Environments []EnvironmentKeyValue `json:"environments"`
+	// EnvMode - which environment variables of the server the command inherits:
+	// inherit (default, all of them), clean (none) or allowlist (the ones matching InheritEnvs)
+	EnvMode string `json:"env_mode,omitempty"`
+	// InheritEnvs - the inherited variables in allowlist mode, glob patterns (e.g. LC_*)
+	InheritEnvs []string `json:"inherit_envs,omitempty"`
+	// UnsetEnvs - variables (glob patterns) removed from the inherited ones
+	UnsetEnvs []string `json:"unset_envs,omitempty"`
+	// Timeout in seconds, 0 means the server's default timeout
+	Timeout int `json:"timeout,omitempty"`
+	// Stdin - if true the command's stdin is a pipe, which can be written through the job's stdin endpoint,
+	// otherwise the command has no stdin
+	Stdin bool `json:"stdin,omitempty"`
+	// TTY - run the command in a pseudo-terminal (its stdout and stderr are merged, stdin is always available)
+	TTY bool `json:"tty,omitempty"`
+	// PolicyFlags - flags required by the server's command policy (require_flag rules)
+	PolicyFlags []string `json:"policy_flags,omitempty"`
+	// TTYSize - the initial size of the pseudo-terminal, default: 24 rows, 80 columns
+	TTYSize *TerminalSizeModel `json:"tty_size,omitempty"`
+	// User - run the command as this user (name or uid), with its HOME, USER and LOGNAME.
+	// The server has to run as root, and the client has to be allowed to use the identity (allowed_identities)
+	User string `json:"user,omitempty"`
+	// Group - run the command with this group (name or gid), default: the user's primary group
+	Group string `json:"group,omitempty"`
+	// Limits - resource limits, capped by the server's max_* config
+	Limits *CommandLimitsModel `json:"limits,omitempty"`
+	// Nice - the nice level (-20 - 19) of the command, it can't be lower than the server's min_nice
+	Nice int `json:"nice,omitempty"`
+	// CPUAffinity - the CPUs (0 based) the command can run on (Linux only)
+	CPUAffinity []int `json:"cpu_affinity,omitempty"`
+	// NoQueue - reject the command (429) if there's no free slot to run it right away, instead of queueing it
+	NoQueue bool `json:"no_queue,omitempty"`
 }
 
 // RunCommandInDirWithArgsEnvsAndWriters ...
-func RunCommandInDirWithArgsEnvsAndWriters(dirPath string, command string, cmdArgs []string, cmdEnvs []string, stdOutWriter, stdErrWriter io.Writer) (int, error) {
+// The command is started in its own process group, which can be signaled through processGroup.
+// If the command is terminated by a signal the exit code is 128 + the signal's number,
+// the same a shell would report.
+// cmdEnvs is the command's whole environment, nothing is inherited from the server.
+// sysProcAttr can be nil.
+// stdinReader can be nil (no stdin), it should be an *os.File (e.g. a pipe) - for any other reader
+// the command is not considered finished until the reader returns EOF.
+func RunCommandInDirWithArgsEnvsAndWriters(dirPath string, command string, cmdArgs []string, cmdEnvs []string, stdinReader io.Reader, stdOutWriter, stdErrWriter io.Writer, sysProcAttr *syscall.SysProcAttr, processGroup *CommandProcessGroup) (int, error) {
 	c := exec.Command(command, cmdArgs...)
-	c.Env = append(os.Environ(), cmdEnvs...)
-	// c.Env = cmdEnvs // only the supported envs, no inherited ones
+	c.SysProcAttr = sysProcAttr
+	// an empty, but not nil Env, a nil one would mean the server's environment
+	c.Env = append([]string{}, cmdEnvs...)
+	c.Stdin = stdinReader
 	c.Stdout = stdOutWriter
 	c.Stderr = stdErrWriter
 	if dirPath != "" {
 		c.Dir = dirPath
 	}
+	processGroup.prepare(c)
+
+	if err := c.Start(); err != nil {
+		processGroup.exited()
+		return 1, err
+	}
+	if err := processGroup.started(c.Process.Pid); err != nil {
+		log.Println(" [!] Failed to deliver pending signal:", err)
+	}
+	err := c.Wait()
+	processGroup.exited()
 
 	cmdExitCode := 0
-	if err := c.Run(); err != nil {
+	if err != nil {
 		// Did the command fail because of an unsuccessful exit code
 		if exitError, ok := err.(*exec.ExitError); ok {
 			waitStatus, ok := exitError.Sys().(syscall.WaitStatus)
@@ -46,6 +107,9 @@ func RunCommandInDirWithArgsEnvsAndWriters(dirPath string, command string, cmdAr
 				return 1, errors.New("Failed to cast exit status")
 			}
 			cmdExitCode = waitStatus.ExitStatus()
+			if waitStatus.Signaled() {
+				cmdExitCode = 128 + int(waitStatus.Signal())
+			}
 		}
 		return cmdExitCode, err
 	}
@@ -65,9 +129,13 @@ func RunCommandInDirWithArgsEnvsAndWriters(dirPath string, command string, cmdAr
 // }
 
 // ExecuteCommand ...
-func ExecuteCommand(cmdToRun CommandModel) (int, error) {
+// If pty is not nil the command runs in the pseudo-terminal (as its controlling terminal),
+// stdinReader is ignored in this case, the command's input is what's written into the pty's master.
+// If Args is specified the program is run directly, otherwise the Command is run with the shell.
+// If pty is not nil and the command is empty an interactive shell is started.
+func ExecuteCommand(cmdToRun CommandModel, stdinReader io.Reader, pty *commandPTY, logWriter *CommandLogWriter, processGroup *CommandProcessGroup) (int, error) {
 	if ConfigIsVerboseLogMode {
-		if err := WriteLineToCommandLog("[[command-start]]"); err != nil {
+		if err := logWriter.WriteLine("[[command-start]]"); err != nil {
 			return 0, err
 		}
 	}
@@ -78,37 +146,93 @@ func ExecuteCommand(cmdToRun CommandModel) (int, error) {
 	// }
 
 	if ConfigIsVerboseLogMode {
-		if err := WriteLineToCommandLog(fmt.Sprintf("Command to run: $ %s", cmdToRun.Command)); err != nil {
+		cmdDescription := cmdToRun.Command
+		if len(cmdToRun.Args) > 0 {
+			cmdDescription = fmt.Sprintf("%q", cmdToRun.Args)
+		}
+		if err := logWriter.WriteLine(fmt.Sprintf("Command to run: $ %s", cmdDescription)); err != nil {
 			log.Println(" [!] Failed to write 'command to run' into Command Log")
 		}
 	}
 
-	cmdExec := "/bin/bash"
-	cmdArgs := []string{
-		"--login",
-		"-c",
-		cmdToRun.Command,
+	var cmdExec string
+	cmdArgs := []string{}
+	if len(cmdToRun.Args) > 0 {
+		cmdExec = cmdToRun.Args[0]
+		cmdArgs = cmdToRun.Args[1:]
+	} else {
+		shell, err := resolveCommandShell(cmdToRun.Shell)
+		if err != nil {
+			return 1, err
+		}
+		cmdExec = shell
+		if isLoginShellRequested(cmdToRun) {
+			cmdArgs = append(cmdArgs, "-l")
+		}
+		// no command in a terminal: an interactive shell
+		if cmdToRun.Command != "" || pty == nil {
+			cmdArgs = append(cmdArgs, "-c", cmdToRun.Command)
+		}
 	}
-	cmdEnvs := []string{}
-	envLength := len(cmdToRun.Environments)
-	if envLength > 0 {
-		cmdEnvs = make([]string, envLength, envLength)
-		for idx, aEnvPair := range cmdToRun.Environments {
-			cmdEnvs[idx] = aEnvPair.Key + "=" + aEnvPair.Value
+
+	identity, err := resolveCommandIdentity(cmdToRun.User, cmdToRun.Group)
+	if err != nil {
+		return 1, err
+	}
+	if identity != nil {
+		// the identity's HOME, USER and LOGNAME, unless the command specifies its own
+		cmdEnvKeys := map[string]bool{}
+		for _, anEnv := range cmdToRun.Environments {
+			cmdEnvKeys[anEnv.Key] = true
+		}
+		identityEnvs := []EnvironmentKeyValue{}
+		for _, anEnv := range identity.environments() {
+			if !cmdEnvKeys[anEnv.Key] {
+				identityEnvs = append(identityEnvs, anEnv)
+			}
+		}
+		cmdToRun.Environments = append(identityEnvs, cmdToRun.Environments...)
+	}
+	cmdEnvs := commandEnvironment(os.Environ(), cmdToRun)
+
+	credential := identity.credential()
+	workingDirectory := cmdToRun.WorkingDirectory
+	if helperSpec := commandExecHelperSpec(cmdToRun); helperSpec != nil {
+		// the exec helper switches to the command's user (and working directory) itself
+		if credential != nil {
+			helperSpec.Credential = credential
+			helperSpec.Dir = workingDirectory
+			credential = nil
+			workingDirectory = ""
+		}
+		cmdExec, cmdArgs, err = wrapWithExecHelper(*helperSpec, cmdExec, cmdArgs)
+		if err != nil {
+			return 1, err
 		}
 	}
 
 	//
-	cmdExitCode, commandErr := RunCommandInDirWithArgsEnvsAndWriters(cmdToRun.WorkingDirectory, cmdExec, cmdArgs, cmdEnvs, CommandLogWriter, CommandLogWriter)
+	var cmdExitCode int
+	var commandErr error
+	if pty != nil {
+		// the pseudo-terminal merges stdout and stderr
+		stdoutWriter := metricsOutputWriter{writer: logWriter.Stdout(), stream: outputStreamStdout}
+		cmdExitCode, commandErr = runCommandInPTY(workingDirectory, cmdExec, cmdArgs, cmdEnvs, pty, stdoutWriter, credential, processGroup)
+	} else {
+		sysProcAttr := &syscall.SysProcAttr{Credential: credential}
+		stdoutWriter := metricsOutputWriter{writer: logWriter.Stdout(), stream: outputStreamStdout}
+		stderrWriter := metricsOutputWriter{writer: logWriter.Stderr(), stream: outputStreamStderr}
+		cmdExitCode, commandErr = RunCommandInDirWithArgsEnvsAndWriters(workingDirectory, cmdExec, cmdArgs, cmdEnvs, stdinReader, stdoutWriter, stderrWriter, sysProcAttr, processGroup)
+	}
 
 	if commandErr != nil {
-		if err := WriteLineToCommandLog(fmt.Sprintf("Command failed: %s", commandErr)); err != nil {
+		if err := logWriter.WriteLine(fmt.Sprintf("Command failed: %s", commandErr)); err != nil {
 			log.Println(" [!] Failed to write 'Command failed' into Command Log")
 		}
 	}
 
 	if ConfigIsVerboseLogMode {
-		if err := WriteLineToCommandLog("[[command-finished]]"); err != nil {
+		if err := logWriter.WriteLine("[[command-finished]]"); err != nil {
 			log.Println(" [!] Failed to write '[[command-finished]]' into Command Log")
 		}
 	}
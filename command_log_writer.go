@@ -5,49 +5,160 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
+	"syscall"
 )
 
-var (
-	// CommandLogWriter ...
-	CommandLogWriter io.Writer
-	commandLogFile   *os.File
+const (
+	// logFormatRaw - the output of the command, as is (stdout and stderr merged)
+	logFormatRaw = "raw"
+	// logFormatNDJSON - the output of the command as "output" stream frames,
+	// which keep track of which stream (stdout / stderr) the output was written to
+	logFormatNDJSON = "ndjson"
+
+	outputStreamStdout = "stdout"
+	outputStreamStderr = "stderr"
 )
 
+// CommandLogWriter ...
+// A CommandLogWriter belongs to a single command run, so commands
+// running in parallel never share (or close) each other's log.
+// The command's stdout and stderr should be written into Stdout() and Stderr(),
+// messages written through the CommandLogWriter itself (e.g. WriteLine) go to stderr.
+type CommandLogWriter struct {
+	mu           sync.Mutex
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+	files        []io.Closer
+}
+
 // OpenCommandLogWriter ...
-func OpenCommandLogWriter(logFilePath string) error {
+// If streamEncoder is not nil the command's output is written into it
+// as well (or only into it, if no log file is defined).
+// If jobLogFilePath is not empty the output is written into it as well (raw format),
+// up to jobLogMaxSize bytes (0 means no limit).
+func OpenCommandLogWriter(logFilePath, logFormat string, jobLogFilePath string, jobLogMaxSize int64, streamEncoder *frameEncoder) (*CommandLogWriter, error) {
+	stdoutWriters := []io.Writer{}
+	stderrWriters := []io.Writer{}
+	files := []io.Closer{}
+
 	if logFilePath != "" {
-		outputfile, err := os.Create(logFilePath)
+		// the path is resolved (and checked) by the server, a symlink replacing the file since then is not followed
+		outputfile, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		commandLogFile = outputfile
-		CommandLogWriter = outputfile
+		files = append(files, outputfile)
 		log.Println(" CommandLog writer opened with file: ", logFilePath)
-	} else {
-		CommandLogWriter = os.Stdout
+
+		if logFormat == logFormatNDJSON {
+			fileEncoder := newFrameEncoder(outputfile)
+			stdoutWriters = append(stdoutWriters, frameOutputWriter{enc: fileEncoder, stream: outputStreamStdout})
+			stderrWriters = append(stderrWriters, frameOutputWriter{enc: fileEncoder, stream: outputStreamStderr})
+		} else {
+			stdoutWriters = append(stdoutWriters, outputfile)
+			stderrWriters = append(stderrWriters, outputfile)
+		}
+	}
+
+	if jobLogFilePath != "" {
+		jobLogFile, err := os.OpenFile(jobLogFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			closeLogFiles(files)
+			return nil, err
+		}
+		jobLogWriter := &cappedFileWriter{file: jobLogFile, maxSize: jobLogMaxSize}
+		files = append(files, jobLogWriter)
+		stdoutWriters = append(stdoutWriters, jobLogWriter)
+		stderrWriters = append(stderrWriters, jobLogWriter)
+		log.Println(" CommandLog writer opened with job log: ", jobLogFilePath)
+	}
+
+	if streamEncoder != nil {
+		log.Println(" CommandLog writer opened with response stream")
+		stdoutWriters = append(stdoutWriters, streamOutputWriter{frameOutputWriter{enc: streamEncoder, stream: outputStreamStdout}})
+		stderrWriters = append(stderrWriters, streamOutputWriter{frameOutputWriter{enc: streamEncoder, stream: outputStreamStderr}})
+	}
+
+	if len(stdoutWriters) == 0 {
 		log.Println(" (!) No Command log file defined!")
 		log.Println(" CommandLog writer opened STDOUT")
+		stdoutWriters = append(stdoutWriters, os.Stdout)
+		stderrWriters = append(stderrWriters, os.Stderr)
 	}
-	return nil
+
+	return &CommandLogWriter{
+		stdoutWriter: io.MultiWriter(stdoutWriters...),
+		stderrWriter: io.MultiWriter(stderrWriters...),
+		files:        files,
+	}, nil
 }
 
-// WriteStringToCommandLog ...
-func WriteStringToCommandLog(s string) error {
-	_, err := io.WriteString(CommandLogWriter, s)
+func closeLogFiles(files []io.Closer) {
+	for _, aFile := range files {
+		if err := aFile.Close(); err != nil {
+			log.Println(" [!] Failed to close CommandLog file:", err)
+		}
+	}
+}
+
+// commandLogStreamWriter writes into one of the streams of a CommandLogWriter
+type commandLogStreamWriter struct {
+	logWriter *CommandLogWriter
+	isStderr  bool
+}
+
+func (w commandLogStreamWriter) Write(p []byte) (int, error) {
+	w.logWriter.mu.Lock()
+	defer w.logWriter.mu.Unlock()
+	if w.isStderr {
+		return w.logWriter.stderrWriter.Write(p)
+	}
+	return w.logWriter.stdoutWriter.Write(p)
+}
+
+// Stdout ...
+func (w *CommandLogWriter) Stdout() io.Writer {
+	return commandLogStreamWriter{logWriter: w}
+}
+
+// Stderr ...
+func (w *CommandLogWriter) Stderr() io.Writer {
+	return commandLogStreamWriter{logWriter: w, isStderr: true}
+}
+
+// Write ...
+func (w *CommandLogWriter) Write(p []byte) (int, error) {
+	return w.Stderr().Write(p)
+}
+
+// WriteString ...
+func (w *CommandLogWriter) WriteString(s string) error {
+	_, err := io.WriteString(w, s)
 	return err
 }
 
-// WriteLineToCommandLog ...
-func WriteLineToCommandLog(s string) error {
-	return WriteStringToCommandLog(fmt.Sprintf("%s\n", s))
+// WriteLine ...
+func (w *CommandLogWriter) WriteLine(s string) error {
+	return w.WriteString(fmt.Sprintf("%s\n", s))
 }
 
-// CloseCommandLogWriter ...
-func CloseCommandLogWriter() error {
-	if commandLogFile != nil {
-		log.Println("CommandLog file closed")
-		return commandLogFile.Close()
+// Close ...
+func (w *CommandLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.files) == 0 {
+		log.Println("No CommandLog file to close")
+		return nil
+	}
+
+	var closeErr error
+	for _, aFile := range w.files {
+		if err := aFile.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
 	}
-	log.Println("No CommandLog file to close")
-	return nil
+	w.files = nil
+	log.Println("CommandLog file closed")
+	return closeErr
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// commands running in parallel have their own CommandLogWriter:
+// no output gets into another command's log, and no output is lost
+func TestCommandLogWriterParallelCommands(t *testing.T) {
+	const commandCount = 8
+	const lineCount = 200
+
+	logDir := t.TempDir()
+	logFilePaths := make([]string, commandCount)
+	errs := make([]error, commandCount)
+	var wg sync.WaitGroup
+	for idx := 0; idx < commandCount; idx++ {
+		logFilePaths[idx] = filepath.Join(logDir, fmt.Sprintf("command-%d.log", idx))
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			errs[idx] = executeLoggedCommand(CommandModel{
+				Command: fmt.Sprintf("for i in $(seq 1 %d); do echo \"cmd-%d out $i\"; echo \"cmd-%d err $i\" >&2; done", lineCount, idx, idx),
+			}, logFilePaths[idx])
+		}(idx)
+	}
+	wg.Wait()
+
+	for idx := 0; idx < commandCount; idx++ {
+		if errs[idx] != nil {
+			t.Errorf("command %d: %s", idx, errs[idx])
+			continue
+		}
+		logBytes, err := ioutil.ReadFile(logFilePaths[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the login shell's profile might print into the log as well,
+		// only the lines printed by the test commands are checked
+		cmdLines := []string{}
+		for _, aLine := range strings.Split(string(logBytes), "\n") {
+			if strings.HasPrefix(aLine, "cmd-") {
+				cmdLines = append(cmdLines, aLine)
+			}
+		}
+		if len(cmdLines) != 2*lineCount {
+			t.Errorf("command %d: expected %d lines, got %d", idx, 2*lineCount, len(cmdLines))
+		}
+		seenLines := map[string]bool{}
+		for _, aLine := range cmdLines {
+			if !strings.HasPrefix(aLine, fmt.Sprintf("cmd-%d ", idx)) {
+				t.Errorf("command %d: unexpected line in its log: %q", idx, aLine)
+				break
+			}
+			seenLines[aLine] = true
+		}
+		for i := 1; i <= lineCount; i++ {
+			for _, aStream := range []string{"out", "err"} {
+				if expectedLine := fmt.Sprintf("cmd-%d %s %d", idx, aStream, i); !seenLines[expectedLine] {
+					t.Errorf("command %d: missing line: %q", idx, expectedLine)
+				}
+			}
+		}
+	}
+}
+
+// a closed CommandLogWriter doesn't close the other writers' files
+func TestCommandLogWriterCloseIsolated(t *testing.T) {
+	logDir := t.TempDir()
+	firstWriter, err := OpenCommandLogWriter(filepath.Join(logDir, "first.log"), logFormatRaw, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondPath := filepath.Join(logDir, "second.log")
+	secondWriter, err := OpenCommandLogWriter(secondPath, logFormatRaw, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := firstWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondWriter.WriteLine("still open"); err != nil {
+		t.Fatalf("writing the second log after closing the first one failed: %s", err)
+	}
+	if err := secondWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logBytes, err := ioutil.ReadFile(secondPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(logBytes) != "still open\n" {
+		t.Errorf("unexpected content of the second log: %q", string(logBytes))
+	}
+}
+
+func executeLoggedCommand(cmdToRun CommandModel, logFilePath string) error {
+	logWriter, err := OpenCommandLogWriter(logFilePath, logFormatRaw, "", 0, nil)
+	if err != nil {
+		return err
+	}
+	exitCode, cmdErr := ExecuteCommand(cmdToRun, nil, nil, logWriter, &CommandProcessGroup{})
+	if err := logWriter.Close(); err != nil {
+		return err
+	}
+	if cmdErr != nil {
+		return cmdErr
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code: %d", exitCode)
+	}
+	return nil
+}
@@ -1,4 +1,479 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // ConfigIsVerboseLogMode ...
 var ConfigIsVerboseLogMode = false
+
+const configEnvPrefix = "CMD_BRIDGE_"
+
+// ConfigDuration ...
+// A time.Duration which is specified as a duration string (e.g. "1h30m") in the config file.
+type ConfigDuration time.Duration
+
+// UnmarshalJSON ...
+func (d *ConfigDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string, like \"1h30m\"")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(duration)
+	return nil
+}
+
+// MarshalJSON ...
+func (d ConfigDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ServerConfigModel ...
+// Every key can be overridden with a CMD_BRIDGE_<KEY IN UPPERCASE> environment variable,
+// list values are comma separated in environment variables.
+type ServerConfigModel struct {
+	// ListenAddress - host:port to listen on
+	ListenAddress string `json:"listen_address"`
+	// DefaultShell - the shell commands are run with, if they don't specify one
+	DefaultShell string `json:"default_shell"`
+	// AllowedShells - the shells commands can request (in addition to the default shell)
+	AllowedShells []string `json:"allowed_shells"`
+	// LoginShell - whether the shell is started as a login shell, if the command doesn't specify it
+	LoginShell bool `json:"login_shell"`
+	// DefaultTimeout is used if the command doesn't specify a timeout, 0 means no timeout
+	DefaultTimeout ConfigDuration `json:"default_timeout"`
+	// MaxTimeout caps the commands' timeout, 0 means no limit
+	MaxTimeout ConfigDuration `json:"max_timeout"`
+	// TimeoutGracePeriod - time between the SIGTERM and SIGKILL sent to a timed out command
+	TimeoutGracePeriod ConfigDuration `json:"timeout_grace_period"`
+	// LogDirectory - if specified, the output of every job is logged here, into JOB_ID.log
+	// (can be retrieved with GET /jobs/{id}/log)
+	LogDirectory string `json:"log_directory"`
+	// MaxLogSizeMB - the max size of a job's log in the log_directory, the rest of the output is dropped, 0 means no limit
+	MaxLogSizeMB int `json:"max_log_size_mb"`
+	// LogRetention - how long the job logs are kept in the log_directory, 0 means forever
+	LogRetention ConfigDuration `json:"log_retention"`
+	// HistoryDirectory - if specified, the job history is stored here (and survives restarts), otherwise only in memory
+	HistoryDirectory string `json:"history_directory"`
+	// HistoryRetention - how long the job records are kept, 0 means forever
+	HistoryRetention ConfigDuration `json:"history_retention"`
+	// AllowedLogDirectories - the directories (or their sub directories) the commands' log_file_path can point into,
+	// if not specified log_file_path is not allowed at all
+	AllowedLogDirectories []string `json:"allowed_log_directories"`
+	// AllowedWorkingDirectories - if specified, commands can only run in these directories (or in their sub directories)
+	AllowedWorkingDirectories []string `json:"allowed_working_directories"`
+	// ProtectedEnvs - the server's environment variables (glob patterns) which are never passed to commands,
+	// in addition to the CMD_BRIDGE_* ones
+	ProtectedEnvs []string `json:"protected_envs"`
+	// MaxConcurrentJobs - max number of commands running at the same time, 0 means no limit
+	MaxConcurrentJobs int `json:"max_concurrent_jobs"`
+	// MaxQueuedJobs - max number of commands waiting for a free slot, commands over this are rejected, 0 means no limit
+	MaxQueuedJobs int `json:"max_queued_jobs"`
+	// MaxCPUTime, MaxAddressSpaceMB, MaxOpenFiles, MaxProcesses, MaxCoreSizeMB - the max resource limits
+	// of the commands, applied to commands which don't specify a limit as well. 0 means no limit
+	MaxCPUTime        ConfigDuration `json:"max_cpu_time"`
+	MaxAddressSpaceMB int            `json:"max_address_space_mb"`
+	MaxOpenFiles      int            `json:"max_open_files"`
+	MaxProcesses      int            `json:"max_processes"`
+	MaxCoreSizeMB     int            `json:"max_core_size_mb"`
+	// MinNice - the lowest nice level (the highest priority) commands can request
+	MinNice int `json:"min_nice"`
+	// TokenFile - auth tokens file
+	TokenFile string `json:"token_file"`
+	// PolicyFile - command policy file
+	PolicyFile string `json:"policy_file"`
+	// AllowedIdentities - which users / groups the clients can run commands as (if the server runs as root):
+	// CLIENT=USER or CLIENT=USER:GROUP items (wildcard patterns), without a GROUP only the user's primary group.
+	// Commands which don't specify a user (or specify the server's own user and group) run as the server's user.
+	AllowedIdentities []string `json:"allowed_identities"`
+	// AdminClients - the clients (wildcard patterns) which can access the jobs of every client,
+	// the other clients can only access their own jobs
+	AdminClients []string `json:"admin_clients"`
+	// AllowedOrigins - the origins (e.g. https://terminal.example.com) browsers can open interactive sessions from,
+	// browser requests from any other origin are rejected
+	AllowedOrigins []string `json:"allowed_origins"`
+	// TLSCert, TLSKey - enables HTTPS
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// TLSClientCA - CA(s) the clients' certificates have to be issued by
+	TLSClientCA string `json:"tls_client_ca"`
+}
+
+// configServer is the active server configuration
+var configServer = defaultServerConfig()
+
+func defaultServerConfig() ServerConfigModel {
+	return ServerConfigModel{
+		ListenAddress:      "127.0.0.1:27473",
+		DefaultShell:       "/bin/bash",
+		LoginShell:         true,
+		TimeoutGracePeriod: ConfigDuration(10 * time.Second),
+		MaxLogSizeMB:       100,
+		LogRetention:       ConfigDuration(7 * 24 * time.Hour),
+		HistoryRetention:   ConfigDuration(30 * 24 * time.Hour),
+	}
+}
+
+// LoadServerConfig ...
+// Starts from the defaults, applies the config file (if specified),
+// then the CMD_BRIDGE_* environment variables.
+func LoadServerConfig(configFilePath string) (ServerConfigModel, error) {
+	config := defaultServerConfig()
+
+	if configFilePath != "" {
+		file, err := os.Open(configFilePath)
+		if err != nil {
+			return ServerConfigModel{}, fmt.Errorf("Failed to open config file: %s", err)
+		}
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		decodeErr := decoder.Decode(&config)
+		if err := file.Close(); err != nil {
+			return ServerConfigModel{}, fmt.Errorf("Failed to close config file: %s", err)
+		}
+		if decodeErr != nil {
+			return ServerConfigModel{}, fmt.Errorf("Invalid config file (%s): %s", configFilePath, decodeErr)
+		}
+	}
+
+	// CMD_BRIDGE_ADDR is the older name of CMD_BRIDGE_LISTEN_ADDRESS
+	if value := os.Getenv("CMD_BRIDGE_ADDR"); value != "" && os.Getenv("CMD_BRIDGE_LISTEN_ADDRESS") == "" {
+		if err := config.Set("listen_address", value); err != nil {
+			return ServerConfigModel{}, fmt.Errorf("Invalid CMD_BRIDGE_ADDR: %s", err)
+		}
+	}
+	for _, key := range config.Keys() {
+		envKey := configEnvPrefix + strings.ToUpper(key)
+		if value := os.Getenv(envKey); value != "" {
+			if err := config.Set(key, value); err != nil {
+				return ServerConfigModel{}, fmt.Errorf("Invalid %s: %s", envKey, err)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// Keys ...
+// The config keys, as they're used in the config file.
+func (config *ServerConfigModel) Keys() []string {
+	keys := []string{}
+	configType := reflect.TypeOf(*config)
+	for i := 0; i < configType.NumField(); i++ {
+		keys = append(keys, configType.Field(i).Tag.Get("json"))
+	}
+	return keys
+}
+
+// Set ...
+// Sets the config key's value from its string representation (e.g. from an environment variable).
+func (config *ServerConfigModel) Set(key, value string) error {
+	configValue := reflect.ValueOf(config).Elem()
+	configType := configValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		if configType.Field(i).Tag.Get("json") != key {
+			continue
+		}
+
+		field := configValue.Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case bool:
+			boolValue, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s should be true or false", key)
+			}
+			field.SetBool(boolValue)
+		case int:
+			intValue, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s should be a number", key)
+			}
+			field.SetInt(int64(intValue))
+		case ConfigDuration:
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s should be a duration, like 1h30m", key)
+			}
+			field.Set(reflect.ValueOf(ConfigDuration(duration)))
+		case []string:
+			items := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("unsupported config type: %s", field.Type())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config key: %s", key)
+}
+
+// Validate ...
+// Returns every problem found, not just the first one.
+func (config *ServerConfigModel) Validate() error {
+	problems := []string{}
+
+	if config.ListenAddress == "" {
+		problems = append(problems, "listen_address: required")
+	}
+
+	if err := checkShellExecutable(config.DefaultShell); err != nil {
+		problems = append(problems, fmt.Sprintf("default_shell: %s", err))
+	}
+	for _, aShell := range config.AllowedShells {
+		if err := checkShellExecutable(aShell); err != nil {
+			problems = append(problems, fmt.Sprintf("allowed_shells: %s", err))
+		}
+	}
+
+	if config.DefaultTimeout < 0 {
+		problems = append(problems, "default_timeout: can't be negative")
+	}
+	if config.MaxTimeout < 0 {
+		problems = append(problems, "max_timeout: can't be negative")
+	}
+	if config.MaxTimeout > 0 && config.DefaultTimeout > config.MaxTimeout {
+		problems = append(problems, "default_timeout: can't be longer than max_timeout")
+	}
+	if config.TimeoutGracePeriod < 0 {
+		problems = append(problems, "timeout_grace_period: can't be negative")
+	}
+
+	if config.LogDirectory != "" {
+		if fileInfo, err := os.Stat(config.LogDirectory); err != nil {
+			problems = append(problems, fmt.Sprintf("log_directory: %s", err))
+		} else if !fileInfo.IsDir() {
+			problems = append(problems, fmt.Sprintf("log_directory: not a directory: %s", config.LogDirectory))
+		}
+	}
+	if config.MaxLogSizeMB < 0 {
+		problems = append(problems, "max_log_size_mb: can't be negative")
+	}
+	if config.LogRetention < 0 {
+		problems = append(problems, "log_retention: can't be negative")
+	}
+
+	if config.HistoryDirectory != "" && !filepath.IsAbs(config.HistoryDirectory) {
+		problems = append(problems, fmt.Sprintf("history_directory: should be an absolute path, got: %s", config.HistoryDirectory))
+	}
+	if config.HistoryRetention < 0 {
+		problems = append(problems, "history_retention: can't be negative")
+	}
+
+	for _, aDir := range config.AllowedLogDirectories {
+		if !filepath.IsAbs(aDir) {
+			problems = append(problems, fmt.Sprintf("allowed_log_directories: should be an absolute path, got: %s", aDir))
+		}
+	}
+	for _, aDir := range config.AllowedWorkingDirectories {
+		if !filepath.IsAbs(aDir) {
+			problems = append(problems, fmt.Sprintf("allowed_working_directories: should be an absolute path, got: %s", aDir))
+		} else if fileInfo, err := os.Stat(aDir); err != nil {
+			problems = append(problems, fmt.Sprintf("allowed_working_directories: %s", err))
+		} else if !fileInfo.IsDir() {
+			problems = append(problems, fmt.Sprintf("allowed_working_directories: not a directory: %s", aDir))
+		}
+	}
+
+	if err := validateEnvPatterns(config.ProtectedEnvs); err != nil {
+		problems = append(problems, fmt.Sprintf("protected_envs: %s", err))
+	}
+
+	if err := validateAllowedIdentities(config.AllowedIdentities); err != nil {
+		problems = append(problems, fmt.Sprintf("allowed_identities: %s", err))
+	}
+
+	if err := validateAllowedOrigins(config.AllowedOrigins); err != nil {
+		problems = append(problems, fmt.Sprintf("allowed_origins: %s", err))
+	}
+
+	if config.MaxConcurrentJobs < 0 {
+		problems = append(problems, "max_concurrent_jobs: can't be negative")
+	}
+	if config.MaxQueuedJobs < 0 {
+		problems = append(problems, "max_queued_jobs: can't be negative")
+	}
+
+	if config.MaxCPUTime < 0 || (config.MaxCPUTime > 0 && time.Duration(config.MaxCPUTime) < time.Second) {
+		problems = append(problems, "max_cpu_time: should be at least 1s (or 0, no limit)")
+	}
+	if config.MaxAddressSpaceMB < 0 {
+		problems = append(problems, "max_address_space_mb: can't be negative")
+	}
+	if config.MaxOpenFiles < 0 {
+		problems = append(problems, "max_open_files: can't be negative")
+	}
+	if config.MaxProcesses < 0 {
+		problems = append(problems, "max_processes: can't be negative")
+	}
+	if config.MaxCoreSizeMB < 0 {
+		problems = append(problems, "max_core_size_mb: can't be negative")
+	}
+	if config.MinNice < -20 || config.MinNice > 19 {
+		problems = append(problems, "min_nice: should be between -20 and 19")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func checkShellExecutable(shellPath string) error {
+	if !filepath.IsAbs(shellPath) {
+		return fmt.Errorf("should be an absolute path, got: %s", shellPath)
+	}
+	fileInfo, err := os.Stat(shellPath)
+	if err != nil {
+		return err
+	}
+	if fileInfo.IsDir() || fileInfo.Mode()&0111 == 0 {
+		return fmt.Errorf("not an executable: %s", shellPath)
+	}
+	return nil
+}
+
+// resolveCommandShell returns the shell to run a command with: the default shell
+// if no shell is requested, otherwise the requested one - if it's the default shell
+// or one of the allowed shells. A shell can be requested by its path, or only by its name (e.g. zsh).
+func resolveCommandShell(requestedShell string) (string, error) {
+	if requestedShell == "" {
+		return configServer.DefaultShell, nil
+	}
+
+	allowedShells := append([]string{configServer.DefaultShell}, configServer.AllowedShells...)
+	for _, anAllowedShell := range allowedShells {
+		if requestedShell == anAllowedShell {
+			return anAllowedShell, nil
+		}
+	}
+	if !strings.Contains(requestedShell, "/") {
+		for _, anAllowedShell := range allowedShells {
+			if filepath.Base(anAllowedShell) == requestedShell {
+				return anAllowedShell, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Shell is not allowed: %s", requestedShell)
+}
+
+// isLoginShellRequested - the command's login setting, or the server's default
+func isLoginShellRequested(cmdToRun CommandModel) bool {
+	if cmdToRun.Login != nil {
+		return *cmdToRun.Login
+	}
+	return configServer.LoginShell
+}
+
+// effectiveCommandTimeout returns the timeout to use for a command
+// which requested the given timeout (in seconds), 0 means no timeout
+func effectiveCommandTimeout(requestedTimeoutSec int) time.Duration {
+	defaultTimeout := time.Duration(configServer.DefaultTimeout)
+	maxTimeout := time.Duration(configServer.MaxTimeout)
+
+	timeout := defaultTimeout
+	if requestedTimeoutSec > 0 {
+		timeout = time.Duration(requestedTimeoutSec) * time.Second
+	}
+	if maxTimeout > 0 && (timeout == 0 || timeout > maxTimeout) {
+		timeout = maxTimeout
+	}
+	return timeout
+}
+
+// checkWorkingDirectoryAllowed - if allowed_working_directories is specified
+// the (symlink resolved) working directory has to be one of those, or inside one of those.
+// An empty working directory means the server's current directory.
+func checkWorkingDirectoryAllowed(workingDirectory string) error {
+	if len(configServer.AllowedWorkingDirectories) == 0 {
+		return nil
+	}
+
+	dir := workingDirectory
+	if dir == "" {
+		currentDir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = currentDir
+	}
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("Invalid working directory: %s", err)
+	}
+
+	for _, anAllowedDir := range configServer.AllowedWorkingDirectories {
+		resolvedAllowedDir, err := filepath.EvalSymlinks(anAllowedDir)
+		if err != nil {
+			continue
+		}
+		if isPathInDirectory(resolvedDir, resolvedAllowedDir) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Working directory is not allowed: %s", dir)
+}
+
+// resolveLogFilePath - the log file has to be in one of the allowed_log_directories (or in their sub directories),
+// after resolving the symlinks of its directory. The log file itself can't be a symlink.
+// Returns the resolved path, the log file should be opened with this path (without following a symlink).
+func resolveLogFilePath(logFilePath string) (string, error) {
+	if len(configServer.AllowedLogDirectories) == 0 {
+		return "", errors.New("log_file_path is not allowed by the server (no allowed_log_directories)")
+	}
+	if !filepath.IsAbs(logFilePath) {
+		return "", fmt.Errorf("Invalid log_file_path: should be an absolute path, got: %s", logFilePath)
+	}
+	cleanPath := filepath.Clean(logFilePath)
+	fileName := filepath.Base(cleanPath)
+	if fileName == string(filepath.Separator) {
+		return "", fmt.Errorf("Invalid log_file_path: %s", logFilePath)
+	}
+	resolvedDir, err := filepath.EvalSymlinks(filepath.Dir(cleanPath))
+	if err != nil {
+		return "", fmt.Errorf("Invalid log_file_path: %s", err)
+	}
+	resolvedPath := filepath.Join(resolvedDir, fileName)
+
+	if fileInfo, err := os.Lstat(resolvedPath); err == nil {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Invalid log_file_path: it's a symlink: %s", logFilePath)
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return "", fmt.Errorf("Invalid log_file_path: not a regular file: %s", logFilePath)
+		}
+	}
+
+	for _, anAllowedDir := range configServer.AllowedLogDirectories {
+		resolvedAllowedDir, err := filepath.EvalSymlinks(anAllowedDir)
+		if err != nil {
+			continue
+		}
+		if isPathInDirectory(resolvedPath, resolvedAllowedDir) && resolvedPath != resolvedAllowedDir {
+			return resolvedPath, nil
+		}
+	}
+	return "", fmt.Errorf("log_file_path is not allowed (not in the allowed_log_directories): %s", logFilePath)
+}
+
+// isPathInDirectory - both paths have to be absolute and clean
+func isPathInDirectory(pth, dir string) bool {
+	return pth == dir || strings.HasPrefix(pth, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
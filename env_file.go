@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// readEnvFile reads a dotenv file: KEY=VALUE lines, optionally prefixed with "export".
+// Empty lines and lines starting with # are skipped. Values can be single quoted (as is),
+// double quoted (\n, \t, \" and \\ escapes are supported), or unquoted (a " #" starts a comment).
+func readEnvFile(pth string) ([]EnvironmentKeyValue, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(" [!] Failed to close env file:", err)
+		}
+	}()
+
+	envs, err := parseEnvFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid env file (%s): %s", pth, err)
+	}
+	return envs, nil
+}
+
+func parseEnvFile(reader io.Reader) ([]EnvironmentKeyValue, error) {
+	envs := []EnvironmentKeyValue{}
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		splits := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(splits[0])
+		if len(splits) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNum)
+		}
+		value, err := parseEnvFileValue(strings.TrimSpace(splits[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		envs = append(envs, EnvironmentKeyValue{Key: key, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+func parseEnvFileValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '\'':
+		end := strings.Index(value[1:], "'")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated single quoted value")
+		}
+		return value[1 : end+1], nil
+	case '"':
+		unquoted := []byte{}
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '"':
+				return string(unquoted), nil
+			case '\\':
+				if i+1 >= len(value) {
+					return "", fmt.Errorf("unterminated double quoted value")
+				}
+				i++
+				switch value[i] {
+				case 'n':
+					unquoted = append(unquoted, '\n')
+				case 't':
+					unquoted = append(unquoted, '\t')
+				default:
+					unquoted = append(unquoted, value[i])
+				}
+			default:
+				unquoted = append(unquoted, value[i])
+			}
+		}
+		return "", fmt.Errorf("unterminated double quoted value")
+	}
+
+	if commentIdx := strings.Index(value, " #"); commentIdx != -1 {
+		value = value[:commentIdx]
+	}
+	return strings.TrimSpace(value), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// envModeInherit - the command gets the server's environment (default)
+	envModeInherit = "inherit"
+	// envModeClean - the command only gets the environment variables specified in the request
+	envModeClean = "clean"
+	// envModeAllowlist - the command only gets the server's environment variables listed in inherit_envs
+	envModeAllowlist = "allowlist"
+)
+
+// serverProtectedEnvPatterns - the server's own configuration (e.g. its auth tokens)
+// never leaks into the commands, regardless of the protected_envs config
+var serverProtectedEnvPatterns = []string{configEnvPrefix + "*"}
+
+// matchesAnyEnvPattern - patterns are shell glob patterns, e.g. AWS_*
+func matchesAnyEnvPattern(key string, patterns []string) bool {
+	for _, aPattern := range patterns {
+		if isMatch, err := path.Match(aPattern, key); err == nil && isMatch {
+			return true
+		}
+	}
+	return false
+}
+
+func validateEnvPatterns(patterns []string) error {
+	for _, aPattern := range patterns {
+		if _, err := path.Match(aPattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern: %s", aPattern)
+		}
+	}
+	return nil
+}
+
+// isServerEnvProtected - protected server environment variables are never passed to commands
+func isServerEnvProtected(key string) bool {
+	return matchesAnyEnvPattern(key, serverProtectedEnvPatterns) || matchesAnyEnvPattern(key, configServer.ProtectedEnvs)
+}
+
+// validateCommandEnvOptions checks the command's environment related options
+func validateCommandEnvOptions(cmdToRun CommandModel) error {
+	switch cmdToRun.EnvMode {
+	case "", envModeInherit, envModeClean, envModeAllowlist:
+	default:
+		return fmt.Errorf("Invalid env_mode: %s", cmdToRun.EnvMode)
+	}
+	if len(cmdToRun.InheritEnvs) > 0 && cmdToRun.EnvMode != envModeAllowlist {
+		return errors.New("inherit_envs can only be used with the allowlist env_mode")
+	}
+	if err := validateEnvPatterns(cmdToRun.InheritEnvs); err != nil {
+		return fmt.Errorf("Invalid inherit_envs: %s", err)
+	}
+	if err := validateEnvPatterns(cmdToRun.UnsetEnvs); err != nil {
+		return fmt.Errorf("Invalid unset_envs: %s", err)
+	}
+	for _, anEnv := range cmdToRun.Environments {
+		if anEnv.Key == "" || strings.Contains(anEnv.Key, "=") {
+			return fmt.Errorf("Invalid environment variable key: %q", anEnv.Key)
+		}
+	}
+	return nil
+}
+
+// commandEnvironment returns the command's environment (KEY=VALUE items):
+// the server's environment variables (serverEnvs) inherited based on the command's env_mode,
+// without the protected and the unset ones, and the command's own environment variables,
+// which override the inherited ones
+func commandEnvironment(serverEnvs []string, cmdToRun CommandModel) []string {
+	cmdEnvKeys := map[string]bool{}
+	for _, anEnv := range cmdToRun.Environments {
+		cmdEnvKeys[anEnv.Key] = true
+	}
+
+	envs := []string{}
+	if cmdToRun.EnvMode != envModeClean {
+		for _, anEnv := range serverEnvs {
+			key := strings.SplitN(anEnv, "=", 2)[0]
+			if cmdEnvKeys[key] || isServerEnvProtected(key) || matchesAnyEnvPattern(key, cmdToRun.UnsetEnvs) {
+				continue
+			}
+			if cmdToRun.EnvMode == envModeAllowlist && !matchesAnyEnvPattern(key, cmdToRun.InheritEnvs) {
+				continue
+			}
+			envs = append(envs, anEnv)
+		}
+	}
+
+	for _, anEnv := range cmdToRun.Environments {
+		envs = append(envs, anEnv.Key+"="+anEnv.Value)
+	}
+	return envs
+}
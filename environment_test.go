@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandEnvironment(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+	configServer.ProtectedEnvs = []string{"AWS_SECRET_*", "SIGNING_KEY"}
+
+	serverEnvs := []string{
+		"PATH=/usr/bin:/bin",
+		"HOME=/Users/vagrant",
+		"LANG=en_US.UTF-8",
+		"AWS_REGION=us-east-1",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"SIGNING_KEY=secret",
+		"CMD_BRIDGE_TOKENS=ci:secret",
+		"CMD_BRIDGE_TOKEN_FILE=/etc/cmd-bridge/tokens",
+		"EMPTY=",
+	}
+
+	for _, tc := range []struct {
+		name string
+		cmd  CommandModel
+		want []string
+	}{
+		{
+			name: "inherit (default)",
+			cmd:  CommandModel{},
+			want: []string{"PATH=/usr/bin:/bin", "HOME=/Users/vagrant", "LANG=en_US.UTF-8", "AWS_REGION=us-east-1", "EMPTY="},
+		},
+		{
+			name: "inherit, the command's envs override the server's",
+			cmd: CommandModel{
+				EnvMode:      envModeInherit,
+				Environments: []EnvironmentKeyValue{{Key: "LANG", Value: "C"}, {Key: "NEW", Value: "1"}},
+			},
+			want: []string{"PATH=/usr/bin:/bin", "HOME=/Users/vagrant", "AWS_REGION=us-east-1", "EMPTY=", "LANG=C", "NEW=1"},
+		},
+		{
+			name: "inherit, unset_envs",
+			cmd:  CommandModel{UnsetEnvs: []string{"AWS_*", "HOME"}},
+			want: []string{"PATH=/usr/bin:/bin", "LANG=en_US.UTF-8", "EMPTY="},
+		},
+		{
+			name: "clean",
+			cmd:  CommandModel{EnvMode: envModeClean},
+			want: []string{},
+		},
+		{
+			name: "clean, only the command's envs",
+			cmd: CommandModel{
+				EnvMode:      envModeClean,
+				Environments: []EnvironmentKeyValue{{Key: "PATH", Value: "/bin"}},
+			},
+			want: []string{"PATH=/bin"},
+		},
+		{
+			name: "allowlist",
+			cmd:  CommandModel{EnvMode: envModeAllowlist, InheritEnvs: []string{"PATH", "AWS_*"}},
+			want: []string{"PATH=/usr/bin:/bin", "AWS_REGION=us-east-1"},
+		},
+		{
+			name: "allowlist, protected envs can't be allowed",
+			cmd:  CommandModel{EnvMode: envModeAllowlist, InheritEnvs: []string{"*"}},
+			want: []string{"PATH=/usr/bin:/bin", "HOME=/Users/vagrant", "LANG=en_US.UTF-8", "AWS_REGION=us-east-1", "EMPTY="},
+		},
+		{
+			name: "allowlist, unset_envs",
+			cmd:  CommandModel{EnvMode: envModeAllowlist, InheritEnvs: []string{"PATH", "AWS_*"}, UnsetEnvs: []string{"AWS_REGION"}},
+			want: []string{"PATH=/usr/bin:/bin"},
+		},
+		{
+			name: "the command can set a protected env itself",
+			cmd: CommandModel{
+				Environments: []EnvironmentKeyValue{{Key: "CMD_BRIDGE_TOKENS", Value: "own"}, {Key: "SIGNING_KEY", Value: "own"}},
+				UnsetEnvs:    []string{"*"},
+			},
+			want: []string{"CMD_BRIDGE_TOKENS=own", "SIGNING_KEY=own"},
+		},
+	} {
+		got := commandEnvironment(serverEnvs, tc.cmd)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\n got: %q\nwant: %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsServerEnvProtected(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+	configServer.ProtectedEnvs = []string{"AWS_SECRET_*"}
+
+	for _, tc := range []struct {
+		key  string
+		want bool
+	}{
+		{key: "CMD_BRIDGE_TOKENS", want: true},
+		{key: "CMD_BRIDGE_", want: true},
+		{key: "AWS_SECRET_ACCESS_KEY", want: true},
+		{key: "AWS_REGION", want: false},
+		{key: "PATH", want: false},
+		{key: "XCMD_BRIDGE_TOKENS", want: false},
+	} {
+		if got := isServerEnvProtected(tc.key); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestValidateCommandEnvOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cmd     CommandModel
+		wantErr bool
+	}{
+		{name: "default", cmd: CommandModel{}, wantErr: false},
+		{name: "allowlist", cmd: CommandModel{EnvMode: envModeAllowlist, InheritEnvs: []string{"PATH"}}, wantErr: false},
+		{name: "unknown env_mode", cmd: CommandModel{EnvMode: "none"}, wantErr: true},
+		{name: "inherit_envs without allowlist", cmd: CommandModel{EnvMode: envModeClean, InheritEnvs: []string{"PATH"}}, wantErr: true},
+		{name: "invalid inherit_envs pattern", cmd: CommandModel{EnvMode: envModeAllowlist, InheritEnvs: []string{"["}}, wantErr: true},
+		{name: "invalid unset_envs pattern", cmd: CommandModel{UnsetEnvs: []string{"["}}, wantErr: true},
+		{name: "invalid env key", cmd: CommandModel{Environments: []EnvironmentKeyValue{{Key: "A=B", Value: "1"}}}, wantErr: true},
+		{name: "empty env key", cmd: CommandModel{Environments: []EnvironmentKeyValue{{Key: "", Value: "1"}}}, wantErr: true},
+	} {
+		err := validateCommandEnvOptions(tc.cmd)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
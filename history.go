@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyFilePrefix     = "jobs-"
+	historyFileSuffix     = ".ndjson"
+	historyFileDateLayout = "2006-01-02"
+
+	// job record statuses, in addition to the ResponseModel's ok / error
+	jobRecordStatusQueued  = "queued"
+	jobRecordStatusRunning = "running"
+)
+
+var (
+	// configHistoryCleanupInterval - how often the records older than history_retention are removed
+	configHistoryCleanupInterval = 1 * time.Hour
+
+	configDefaultJobListLimit = 100
+	configMaxJobListLimit     = 1000
+
+	serverJobHistory = &JobHistoryStore{}
+)
+
+// JobRecordModel ...
+// A job in the job history. Environment variable values are never stored, only the keys.
+type JobRecordModel struct {
+	ID               string   `json:"id"`
+	Client           string   `json:"client,omitempty"`
+	Command          string   `json:"command,omitempty"`
+	Args             []string `json:"args,omitempty"`
+	WorkingDirectory string   `json:"working_directory,omitempty"`
+	EnvKeys          []string `json:"env_keys,omitempty"`
+	User             string   `json:"user,omitempty"`
+	// Status - queued, running, or the result's status: ok / error
+	Status        string     `json:"status"`
+	ExitCode      int        `json:"exit_code"`
+	Signal        string     `json:"signal,omitempty"`
+	Cancelled     bool       `json:"cancelled,omitempty"`
+	TimedOut      bool       `json:"timed_out,omitempty"`
+	LimitExceeded string     `json:"limit_exceeded,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	// DurationSec - the time the command ran (without the time it was queued), in seconds
+	DurationSec float64 `json:"duration_sec,omitempty"`
+}
+
+// JobListModel ...
+// The response of GET /jobs
+type JobListModel struct {
+	Jobs []JobRecordModel `json:"jobs"`
+}
+
+// JobRecordFilter ...
+// Every specified condition has to match.
+type JobRecordFilter struct {
+	// Statuses - any of these
+	Statuses []string
+	// Since, Until - the job's created_at
+	Since    time.Time
+	Until    time.Time
+	ExitCode *int
+	Client   string
+	// Owner - if not nil only the jobs of this client (an empty string is the anonymous client)
+	Owner *string
+	Limit int
+}
+
+// JobHistoryStore ...
+// Records of the finished jobs, for history_retention. If directory is specified
+// the records are also written into it (one file per day), and loaded on startup.
+type JobHistoryStore struct {
+	mu        sync.Mutex
+	directory string
+	retention time.Duration
+	records   []JobRecordModel
+}
+
+// NewJobHistoryStore ...
+// Loads the records of the directory (if specified), retention: 0 means no limit.
+func NewJobHistoryStore(directory string, retention time.Duration) (*JobHistoryStore, error) {
+	store := &JobHistoryStore{directory: directory, retention: retention}
+	if directory == "" {
+		return store, nil
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create history directory: %s", err)
+	}
+	store.removeExpired()
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	log.Printf(" (i) Loaded %d job record(s) from: %s", len(store.records), directory)
+	return store, nil
+}
+
+// StartCleanup removes the expired records periodically
+func (store *JobHistoryStore) StartCleanup() {
+	if store.retention <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(configHistoryCleanupInterval) {
+			store.removeExpired()
+		}
+	}()
+}
+
+// Add ...
+// The record of a finished job.
+func (store *JobHistoryStore) Add(record JobRecordModel) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.records = append(store.records, record)
+	if store.directory == "" {
+		return
+	}
+	if err := store.appendToFile(record); err != nil {
+		log.Printf(" [!] Failed to write the record of job %s into the history: %s", record.ID, err)
+	}
+}
+
+// Get ...
+// The record of the job, false if the job is not in the history.
+func (store *JobHistoryStore) Get(jobID string) (JobRecordModel, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for idx := len(store.records) - 1; idx >= 0; idx-- {
+		if store.records[idx].ID == jobID {
+			return store.records[idx], true
+		}
+	}
+	return JobRecordModel{}, false
+}
+
+// appendToFile - store.mu has to be locked by the caller
+func (store *JobHistoryStore) appendToFile(record JobRecordModel) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(store.filePath(record.CreatedAt), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(recordBytes, '\n')); err != nil {
+		closeFiles(file)
+		return err
+	}
+	return file.Close()
+}
+
+func (store *JobHistoryStore) filePath(t time.Time) string {
+	return filepath.Join(store.directory, historyFilePrefix+t.UTC().Format(historyFileDateLayout)+historyFileSuffix)
+}
+
+// historyFileDate - the day of the history file's records, false if it's not a history file
+func historyFileDate(fileName string) (time.Time, bool) {
+	if !strings.HasPrefix(fileName, historyFilePrefix) || !strings.HasSuffix(fileName, historyFileSuffix) {
+		return time.Time{}, false
+	}
+	day, err := time.Parse(historyFileDateLayout, strings.TrimSuffix(strings.TrimPrefix(fileName, historyFilePrefix), historyFileSuffix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+func (store *JobHistoryStore) load() error {
+	fileInfos, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		return fmt.Errorf("Failed to read history directory: %s", err)
+	}
+
+	records := []JobRecordModel{}
+	for _, aFileInfo := range fileInfos {
+		if _, isHistoryFile := historyFileDate(aFileInfo.Name()); !isHistoryFile {
+			continue
+		}
+		fileRecords, err := readJobRecordsFile(filepath.Join(store.directory, aFileInfo.Name()))
+		if err != nil {
+			return err
+		}
+		records = append(records, fileRecords...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	store.mu.Lock()
+	store.records = records
+	store.mu.Unlock()
+	store.removeExpired()
+	return nil
+}
+
+// readJobRecordsFile - an invalid line (e.g. partially written, if the server was killed) is skipped
+func readJobRecordsFile(pth string) ([]JobRecordModel, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open history file: %s", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(" [!] Failed to close history file:", err)
+		}
+	}()
+
+	records := []JobRecordModel{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		var record JobRecordModel
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf(" [!] Invalid job record in %s, line %d, skipping: %s", pth, lineNum, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read history file (%s): %s", pth, err)
+	}
+	return records, nil
+}
+
+// removeExpired removes the records (and the history files) older than the retention
+func (store *JobHistoryStore) removeExpired() {
+	if store.retention <= 0 {
+		return
+	}
+	expiry := time.Now().Add(-store.retention)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// the records are added when the jobs finish, so they are not ordered by CreatedAt
+	keptRecords := []JobRecordModel{}
+	for _, aRecord := range store.records {
+		if !aRecord.CreatedAt.Before(expiry) {
+			keptRecords = append(keptRecords, aRecord)
+		}
+	}
+	store.records = keptRecords
+
+	if store.directory == "" {
+		return
+	}
+	fileInfos, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		log.Println(" [!] Failed to read history directory:", err)
+		return
+	}
+	for _, aFileInfo := range fileInfos {
+		day, isHistoryFile := historyFileDate(aFileInfo.Name())
+		// the file has records from the whole day
+		if !isHistoryFile || !day.Add(24*time.Hour).Before(expiry) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(store.directory, aFileInfo.Name())); err != nil {
+			log.Println(" [!] Failed to remove expired history file:", err)
+		}
+	}
+}
+
+// List ...
+// The matching records, the newest first. activeRecords (e.g. the records of the jobs which are
+// not yet finished) are listed as well, they override the stored records with the same ID.
+func (store *JobHistoryStore) List(filter JobRecordFilter, activeRecords []JobRecordModel) []JobRecordModel {
+	store.mu.Lock()
+	allRecords := append([]JobRecordModel{}, store.records...)
+	store.mu.Unlock()
+
+	activeIDs := map[string]bool{}
+	for _, aRecord := range activeRecords {
+		activeIDs[aRecord.ID] = true
+	}
+	for _, aRecord := range allRecords {
+		if !activeIDs[aRecord.ID] {
+			activeRecords = append(activeRecords, aRecord)
+		}
+	}
+	allRecords = activeRecords
+	sort.SliceStable(allRecords, func(i, j int) bool { return allRecords[i].CreatedAt.After(allRecords[j].CreatedAt) })
+
+	records := []JobRecordModel{}
+	for _, aRecord := range allRecords {
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+		if filter.matches(aRecord) {
+			records = append(records, aRecord)
+		}
+	}
+	return records
+}
+
+func (filter JobRecordFilter) matches(record JobRecordModel) bool {
+	if len(filter.Statuses) > 0 {
+		isAnyMatching := false
+		for _, aStatus := range filter.Statuses {
+			if aStatus == record.Status {
+				isAnyMatching = true
+				break
+			}
+		}
+		if !isAnyMatching {
+			return false
+		}
+	}
+	if !filter.Since.IsZero() && record.CreatedAt.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && record.CreatedAt.After(filter.Until) {
+		return false
+	}
+	if filter.ExitCode != nil && (record.FinishedAt == nil || record.ExitCode != *filter.ExitCode) {
+		return false
+	}
+	if filter.Client != "" && record.Client != filter.Client {
+		return false
+	}
+	if filter.Owner != nil && record.Client != *filter.Owner {
+		return false
+	}
+	return true
+}
+
+// parseJobRecordFilter parses the GET /jobs query params: status (comma separated),
+// since / until (RFC 3339 time, or a duration: that long ago, e.g. 24h), exit_code, client and limit
+func parseJobRecordFilter(query url.Values) (JobRecordFilter, error) {
+	filter := JobRecordFilter{Limit: configDefaultJobListLimit, Client: query.Get("client")}
+
+	for _, aStatus := range strings.Split(query.Get("status"), ",") {
+		switch aStatus = strings.TrimSpace(aStatus); aStatus {
+		case "":
+		case jobRecordStatusQueued, jobRecordStatusRunning, configOkStatusMsg, configErrorStatusMsg:
+			filter.Statuses = append(filter.Statuses, aStatus)
+		default:
+			return JobRecordFilter{}, fmt.Errorf("Invalid status: %s (should be queued, running, ok or error)", aStatus)
+		}
+	}
+
+	var err error
+	if filter.Since, err = parseJobListTime(query.Get("since")); err != nil {
+		return JobRecordFilter{}, fmt.Errorf("Invalid since: %s", err)
+	}
+	if filter.Until, err = parseJobListTime(query.Get("until")); err != nil {
+		return JobRecordFilter{}, fmt.Errorf("Invalid until: %s", err)
+	}
+
+	if exitCodeParam := query.Get("exit_code"); exitCodeParam != "" {
+		exitCode, err := strconv.Atoi(exitCodeParam)
+		if err != nil {
+			return JobRecordFilter{}, fmt.Errorf("Invalid exit_code: %s", exitCodeParam)
+		}
+		filter.ExitCode = &exitCode
+	}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			return JobRecordFilter{}, fmt.Errorf("Invalid limit: %s", limitParam)
+		}
+		filter.Limit = limit
+	}
+	if filter.Limit > configMaxJobListLimit {
+		filter.Limit = configMaxJobListLimit
+	}
+	return filter, nil
+}
+
+// parseJobListTime - an RFC 3339 time, or a duration (that long ago), empty means no limit
+func parseJobListTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Time{}, errors.New("should be an RFC 3339 time (e.g. 2006-01-02T15:04:05Z) or a duration (e.g. 24h)")
+}
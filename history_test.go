@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the records are added in the order the jobs finish, a long running job's record
+// is added after the records of the jobs which were created later
+func TestJobHistoryStoreRemoveExpiredOutOfOrder(t *testing.T) {
+	store, err := NewJobHistoryStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, aRecord := range []JobRecordModel{
+		{ID: "recent-1", CreatedAt: now.Add(-10 * time.Minute)},
+		{ID: "expired-long-running", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "recent-2", CreatedAt: now.Add(-5 * time.Minute)},
+		{ID: "expired", CreatedAt: now.Add(-90 * time.Minute)},
+	} {
+		store.Add(aRecord)
+	}
+
+	store.removeExpired()
+
+	for _, jobID := range []string{"recent-1", "recent-2"} {
+		if _, isFound := store.Get(jobID); !isFound {
+			t.Errorf("%s: should be kept", jobID)
+		}
+	}
+	for _, jobID := range []string{"expired-long-running", "expired"} {
+		if _, isFound := store.Get(jobID); isFound {
+			t.Errorf("%s: should be removed", jobID)
+		}
+	}
+}
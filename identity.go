@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// commandIdentity - the Unix user and group a command runs as
+type commandIdentity struct {
+	uid        uint32
+	gid        uint32
+	primaryGid uint32
+	groups     []uint32
+	userName   string
+	groupName  string
+	homeDir    string
+}
+
+// resolveCommandIdentity looks up the requested user (name or uid) and group (name or gid),
+// the group defaults to the user's primary group. Returns nil if no user is requested.
+// Running a command as another user is only possible if the server runs as root.
+func resolveCommandIdentity(userName, groupName string) (*commandIdentity, error) {
+	if userName == "" {
+		if groupName != "" {
+			return nil, errors.New("group can only be specified with user")
+		}
+		return nil, nil
+	}
+
+	usr, err := lookupUser(userName)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid uid of user %s: %s", usr.Username, usr.Uid)
+	}
+	primaryGid, err := strconv.ParseUint(usr.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gid of user %s: %s", usr.Username, usr.Gid)
+	}
+
+	identity := &commandIdentity{
+		uid:        uint32(uid),
+		gid:        uint32(primaryGid),
+		primaryGid: uint32(primaryGid),
+		userName:   usr.Username,
+		homeDir:    usr.HomeDir,
+	}
+
+	grp, err := lookupGroup(groupName, usr.Gid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(grp.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gid of group %s: %s", grp.Name, grp.Gid)
+	}
+	identity.gid = uint32(gid)
+	identity.groupName = grp.Name
+
+	groupIDs, err := usr.GroupIds()
+	if err != nil {
+		// e.g. no supplementary group information is available
+		groupIDs = []string{usr.Gid}
+	}
+	for _, aGroupID := range groupIDs {
+		if aGid, err := strconv.ParseUint(aGroupID, 10, 32); err == nil {
+			identity.groups = append(identity.groups, uint32(aGid))
+		}
+	}
+
+	if os.Geteuid() != 0 && !identity.isCurrentProcessIdentity() {
+		return nil, fmt.Errorf("The server has to run as root to run commands as another user (%s:%s)", identity.userName, identity.groupName)
+	}
+	return identity, nil
+}
+
+func lookupUser(userName string) (*user.User, error) {
+	usr, err := user.Lookup(userName)
+	if err == nil {
+		return usr, nil
+	}
+	if _, parseErr := strconv.ParseUint(userName, 10, 32); parseErr == nil {
+		if usr, idErr := user.LookupId(userName); idErr == nil {
+			return usr, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown user: %s", userName)
+}
+
+// lookupGroup - if groupName is empty the group with defaultGid
+func lookupGroup(groupName, defaultGid string) (*user.Group, error) {
+	if groupName == "" {
+		grp, err := user.LookupGroupId(defaultGid)
+		if err != nil {
+			// a primary group which is not in the group database
+			return &user.Group{Gid: defaultGid, Name: defaultGid}, nil
+		}
+		return grp, nil
+	}
+
+	grp, err := user.LookupGroup(groupName)
+	if err == nil {
+		return grp, nil
+	}
+	if _, parseErr := strconv.ParseUint(groupName, 10, 32); parseErr == nil {
+		if grp, idErr := user.LookupGroupId(groupName); idErr == nil {
+			return grp, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown group: %s", groupName)
+}
+
+func (identity *commandIdentity) isCurrentProcessIdentity() bool {
+	return int(identity.uid) == os.Geteuid() && int(identity.gid) == os.Getegid()
+}
+
+// credential - nil if the command can run with the server's own credentials
+func (identity *commandIdentity) credential() *syscall.Credential {
+	if identity == nil || identity.isCurrentProcessIdentity() {
+		return nil
+	}
+	return &syscall.Credential{
+		Uid:    identity.uid,
+		Gid:    identity.gid,
+		Groups: identity.groups,
+	}
+}
+
+// environments - the identity's HOME, USER and LOGNAME
+func (identity *commandIdentity) environments() []EnvironmentKeyValue {
+	return []EnvironmentKeyValue{
+		{Key: "HOME", Value: identity.homeDir},
+		{Key: "USER", Value: identity.userName},
+		{Key: "LOGNAME", Value: identity.userName},
+	}
+}
+
+// validateAllowedIdentities checks the allowed_identities config items:
+// CLIENT=USER or CLIENT=USER:GROUP, every part is a wildcard pattern
+func validateAllowedIdentities(items []string) error {
+	for _, anItem := range items {
+		clientPattern, userPattern, _, isValid := parseAllowedIdentity(anItem)
+		if !isValid || clientPattern == "" || userPattern == "" {
+			return fmt.Errorf("invalid item, expected CLIENT=USER or CLIENT=USER:GROUP, got: %s", anItem)
+		}
+	}
+	return nil
+}
+
+func parseAllowedIdentity(item string) (clientPattern, userPattern, groupPattern string, isValid bool) {
+	splits := strings.SplitN(item, "=", 2)
+	if len(splits) != 2 {
+		return "", "", "", false
+	}
+	clientPattern = strings.TrimSpace(splits[0])
+	userAndGroup := strings.SplitN(splits[1], ":", 2)
+	userPattern = strings.TrimSpace(userAndGroup[0])
+	if len(userAndGroup) == 2 {
+		groupPattern = strings.TrimSpace(userAndGroup[1])
+	}
+	return clientPattern, userPattern, groupPattern, true
+}
+
+// isIdentityAllowedForClient - an allowed_identities item without a group
+// only allows the user's primary group
+func isIdentityAllowedForClient(identity *commandIdentity, clientName string) bool {
+	for _, anItem := range configServer.AllowedIdentities {
+		clientPattern, userPattern, groupPattern, isValid := parseAllowedIdentity(anItem)
+		if !isValid || !matchWildcard(clientPattern, clientName) || !matchWildcard(userPattern, identity.userName) {
+			continue
+		}
+		if groupPattern == "" {
+			if identity.gid == identity.primaryGid {
+				return true
+			}
+			continue
+		}
+		if matchWildcard(groupPattern, identity.groupName) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCommandIdentityAllowed - returns a denial if the client
+// is not allowed to run the command as the requested user / group.
+// The server's own user and group is always allowed, the same as not specifying a user.
+func checkCommandIdentityAllowed(cmdToRun CommandModel, clientName string) *PolicyDenialModel {
+	identity, err := resolveCommandIdentity(cmdToRun.User, cmdToRun.Group)
+	if err != nil {
+		return &PolicyDenialModel{Reason: err.Error()}
+	}
+	if identity == nil || identity.isCurrentProcessIdentity() || isIdentityAllowedForClient(identity, clientName) {
+		return nil
+	}
+	return &PolicyDenialModel{
+		Reason: fmt.Sprintf("the client is not allowed to run commands as %s:%s", identity.userName, identity.groupName),
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestCheckCommandIdentityAllowed(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+	configServer.AllowedIdentities = []string{"ci=nobody"}
+
+	serverUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverUser.Gid != strconv.Itoa(os.Getegid()) {
+		t.Skip("the server's group is not its user's primary group")
+	}
+
+	// the server's own identity doesn't need an allowed_identities item
+	for _, clientName := range []string{"ci", "other"} {
+		if denial := checkCommandIdentityAllowed(CommandModel{User: serverUser.Username}, clientName); denial != nil {
+			t.Errorf("%s: the server's own user should be allowed, got denial: %s", clientName, denial.Reason)
+		}
+		if denial := checkCommandIdentityAllowed(CommandModel{User: serverUser.Uid}, clientName); denial != nil {
+			t.Errorf("%s: the server's own uid should be allowed, got denial: %s", clientName, denial.Reason)
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		return
+	}
+	if denial := checkCommandIdentityAllowed(CommandModel{User: "nobody"}, "ci"); denial != nil {
+		t.Errorf("ci: nobody should be allowed, got denial: %s", denial.Reason)
+	}
+	if denial := checkCommandIdentityAllowed(CommandModel{User: "nobody"}, "other"); denial == nil {
+		t.Error("other: nobody should not be allowed")
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	jobStateQueued   = "queued"
+	jobStateRunning  = "running"
+	jobStateFinished = "finished"
+)
+
+var (
+	// finished jobs are kept around (for status queries) at least for this long
+	configFinishedJobRetention = 1 * time.Hour
+
+	// configQueueFullRetryAfter - sent in the Retry-After header, if a job is rejected because the server is busy
+	configQueueFullRetryAfter = 10 * time.Second
+
+	serverJobManager = NewJobManager(0, 0)
+)
+
+var (
+	errJobQueueFull = errors.New("The server is busy: the job queue is full")
+	errNoFreeSlot   = errors.New("The server is busy: no free slot to run the command right away")
+)
+
+// JobStatusModel ...
+type JobStatusModel struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	ExitCode   int        `json:"exit_code"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// QueuePosition - the job's position (1 based) in the queue, while it's queued
+	QueuePosition int            `json:"queue_position,omitempty"`
+	Result        *ResponseModel `json:"result,omitempty"`
+}
+
+// Job ...
+type Job struct {
+	ID      string
+	Command CommandModel
+	// ClientName - the client which submitted the job, empty if it's not identified
+	ClientName string
+
+	// streamEncoder (optional) receives the command's output
+	//  in addition to the command's log
+	streamEncoder *frameEncoder
+	processGroup  *CommandProcessGroup
+	// stdinReader / stdinWriter - the two ends of the command's stdin pipe (if the command requested stdin),
+	// in tty mode stdinReader is nil and stdinWriter writes into the pty
+	stdinReader *os.File
+	stdinWriter io.WriteCloser
+	pty         *commandPTY
+
+	mu          sync.Mutex
+	state       string
+	isCancelled bool
+	isTimedOut  bool
+	cancelChan  chan struct{}
+	// isStdinTaken - the stdin can only be written by a single request
+	isStdinTaken bool
+	result       ResponseModel
+	createdAt    time.Time
+	startedAt    time.Time
+	finishedAt   time.Time
+	done         chan struct{}
+
+	// queuePosition - 0 if the job is not queued (anymore)
+	queuePosition int
+	// queueUpdated - signaled when the job's queue position changes
+	queueUpdated chan struct{}
+	// slotGranted - closed when the job can start
+	slotGranted chan struct{}
+}
+
+// NewJob ...
+// The job has to be started with JobManager.Submit
+func NewJob(cmdToRun CommandModel, clientName string, streamEncoder *frameEncoder) (*Job, error) {
+	jobID, err := generateJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		ID:            jobID,
+		Command:       cmdToRun,
+		ClientName:    clientName,
+		streamEncoder: streamEncoder,
+		processGroup:  &CommandProcessGroup{},
+		state:         jobStateQueued,
+		createdAt:     time.Now(),
+		done:          make(chan struct{}),
+		cancelChan:    make(chan struct{}),
+		queueUpdated:  make(chan struct{}, 1),
+		slotGranted:   make(chan struct{}),
+	}
+
+	if cmdToRun.TTY {
+		ttySize := defaultTTYSize
+		if cmdToRun.TTYSize != nil {
+			ttySize = *cmdToRun.TTYSize
+		}
+		job.pty, err = newCommandPTY(ttySize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create pty: %s", err)
+		}
+		job.stdinWriter = ptyStdinWriter{pty: job.pty}
+	} else if cmdToRun.Stdin {
+		// an os.Pipe, so the command gets the read end directly
+		job.stdinReader, job.stdinWriter, err = os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create stdin pipe: %s", err)
+		}
+	}
+
+	return job, nil
+}
+
+// Resize ...
+// Resizes the job's pseudo-terminal (only in tty mode).
+func (job *Job) Resize(size TerminalSizeModel) error {
+	if job.pty == nil {
+		return errors.New("The command is not running in tty mode")
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.state == jobStateFinished {
+		return errors.New("Job already finished")
+	}
+	return job.pty.Resize(size)
+}
+
+// TakeStdinWriter ...
+// Returns the write end of the command's stdin, closing it signals EOF to the command.
+// It can only be taken once, and only if the command requested stdin.
+func (job *Job) TakeStdinWriter() (io.WriteCloser, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.stdinWriter == nil {
+		return nil, errors.New("The command has no stdin (stdin was not requested)")
+	}
+	if job.isStdinTaken {
+		return nil, errors.New("The command's stdin is already being written")
+	}
+	if job.state == jobStateFinished {
+		return nil, errors.New("Job already finished")
+	}
+	job.isStdinTaken = true
+	return job.stdinWriter, nil
+}
+
+// Done ...
+// The returned channel is closed when the job is finished.
+func (job *Job) Done() <-chan struct{} {
+	return job.done
+}
+
+// Result ...
+// Only valid once the job is finished.
+func (job *Job) Result() ResponseModel {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.result
+}
+
+// Status ...
+func (job *Job) Status() JobStatusModel {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	status := JobStatusModel{
+		ID:        job.ID,
+		State:     job.state,
+		CreatedAt: job.createdAt,
+	}
+	if job.state == jobStateQueued {
+		status.QueuePosition = job.queuePosition
+	}
+	if !job.startedAt.IsZero() {
+		startedAt := job.startedAt
+		status.StartedAt = &startedAt
+	}
+	if job.state == jobStateFinished {
+		finishedAt := job.finishedAt
+		result := job.result
+		status.FinishedAt = &finishedAt
+		status.ExitCode = result.ExitCode
+		status.Result = &result
+	}
+	return status
+}
+
+// Record ...
+// The job's record for the job history.
+func (job *Job) Record() JobRecordModel {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	record := JobRecordModel{
+		ID:               job.ID,
+		Client:           job.ClientName,
+		Command:          job.Command.Command,
+		Args:             job.Command.Args,
+		WorkingDirectory: job.Command.WorkingDirectory,
+		User:             job.Command.User,
+		CreatedAt:        job.createdAt,
+	}
+	for _, anEnv := range job.Command.Environments {
+		record.EnvKeys = append(record.EnvKeys, anEnv.Key)
+	}
+
+	switch job.state {
+	case jobStateQueued:
+		record.Status = jobRecordStatusQueued
+	case jobStateRunning:
+		record.Status = jobRecordStatusRunning
+	default:
+		record.Status = job.result.Status
+		record.ExitCode = job.result.ExitCode
+		record.Signal = job.result.Signal
+		record.Cancelled = job.result.Cancelled
+		record.TimedOut = job.result.TimedOut
+		record.LimitExceeded = job.result.LimitExceeded
+		finishedAt := job.finishedAt
+		record.FinishedAt = &finishedAt
+	}
+	if !job.startedAt.IsZero() {
+		startedAt := job.startedAt
+		record.StartedAt = &startedAt
+		if record.FinishedAt != nil {
+			record.DurationSec = record.FinishedAt.Sub(startedAt).Seconds()
+		}
+	}
+	return record
+}
+
+// Signal ...
+// Sends the signal to the job's command (process group), without cancelling the job.
+func (job *Job) Signal(sig syscall.Signal) error {
+	job.mu.Lock()
+	isFinished := job.state == jobStateFinished
+	job.mu.Unlock()
+	if isFinished {
+		return fmt.Errorf("Job already finished")
+	}
+
+	log.Printf(" (i) Job %s: sending %s", job.ID, SignalName(sig))
+	return job.processGroup.Signal(sig)
+}
+
+// Cancel ...
+// Sends the signal to the job's command (process group).
+// A job which is not yet started won't be started at all.
+func (job *Job) Cancel(sig syscall.Signal) error {
+	job.mu.Lock()
+	if job.state == jobStateFinished {
+		job.mu.Unlock()
+		return fmt.Errorf("Job already finished")
+	}
+	if !job.isCancelled {
+		job.isCancelled = true
+		close(job.cancelChan)
+	}
+	job.mu.Unlock()
+
+	log.Printf(" (i) Job %s: sending %s", job.ID, SignalName(sig))
+	return job.processGroup.Signal(sig)
+}
+
+func (job *Job) run() {
+	job.mu.Lock()
+	if job.isCancelled {
+		job.mu.Unlock()
+		log.Printf(" (i) Job %s cancelled before it was started", job.ID)
+		serverMetrics.CountCommand(commandOutcomeCancelled)
+		job.finish(ResponseModel{
+			Status:    configErrorStatusMsg,
+			Msg:       "Job cancelled before it was started",
+			ExitCode:  1,
+			Cancelled: true,
+		})
+		return
+	}
+	job.state = jobStateRunning
+	job.startedAt = time.Now()
+	startedAt := job.startedAt
+	job.mu.Unlock()
+
+	log.Printf(" (i) Job %s started", job.ID)
+
+	timeout := effectiveCommandTimeout(job.Command.Timeout)
+	if timeout > 0 {
+		stopTimeout := job.startTimeout(timeout)
+		defer stopTimeout()
+	}
+
+	// resolved again, the directories could have changed since the command was accepted (e.g. while it was queued)
+	logFilePath := ""
+	var err error
+	if job.Command.LogFilePath != "" {
+		logFilePath, err = resolveLogFilePath(job.Command.LogFilePath)
+	}
+	var logWriter *CommandLogWriter
+	if err == nil {
+		logWriter, err = OpenCommandLogWriter(logFilePath, job.Command.LogFormat,
+			jobLogFilePath(job.ID), int64(configServer.MaxLogSizeMB)<<20, job.streamEncoder)
+	}
+	cmdExitCode := 0
+	// the OOM killer doesn't tell which process it killed: if the command got a SIGKILL,
+	// and the OOM kill count changed while it was running, it was (most likely) the command
+	var oomKillsBefore uint64
+	isOOMKillCountKnown := false
+	if err == nil {
+		var stdinReader io.Reader
+		if job.stdinReader != nil {
+			stdinReader = job.stdinReader
+		}
+		oomKillsBefore, isOOMKillCountKnown = oomKillCount()
+		cmdExitCode, err = ExecuteCommand(job.Command, stdinReader, job.pty, logWriter, job.processGroup)
+	}
+
+	job.mu.Lock()
+	isCancelled := job.isCancelled
+	isTimedOut := job.isTimedOut
+	job.mu.Unlock()
+
+	statusMsg := configOkStatusMsg
+	respMsg := "Command finished with success"
+	if err != nil {
+		log.Printf(" [!] Job %s error: %s", job.ID, err)
+		statusMsg = configErrorStatusMsg
+		respMsg = fmt.Sprintf("%s", err)
+	}
+	if isTimedOut {
+		statusMsg = configErrorStatusMsg
+		respMsg = fmt.Sprintf("Command timed out after %s", timeout)
+	}
+	signalName := ""
+	if sig, isSignaled := terminatingSignal(err); isSignaled {
+		signalName = SignalName(sig)
+	}
+	limitExceeded := ""
+	if !isCancelled && !isTimedOut {
+		oomKillsAfter, _ := oomKillCount()
+		isOOMKillCounted := isOOMKillCountKnown && oomKillsAfter > oomKillsBefore
+		limitExceeded = exceededLimit(err, effectiveCommandLimits(job.Command.Limits).CPUTime, isOOMKillCounted)
+	}
+	if limitExceeded != "" {
+		respMsg = fmt.Sprintf("Command exceeded its %s limit", limitExceeded)
+	}
+	serverMetrics.CountCommand(commandOutcome(err, isCancelled, isTimedOut))
+	serverMetrics.ObserveCommandDuration(time.Since(startedAt))
+
+	if logWriter != nil {
+		if isTimedOut || limitExceeded != "" {
+			if err := logWriter.WriteLine(respMsg); err != nil {
+				log.Println(" [!] Failed to write the termination reason into Command Log")
+			}
+		}
+		if ConfigIsVerboseLogMode {
+			if err := logWriter.WriteLine("-> Command Finished"); err != nil {
+				log.Println(" [!] Failed to write 'Command Finished' into Command Log")
+			}
+		}
+		if err := logWriter.Close(); err != nil {
+			log.Println(" [!] Failed to close CommandLogWriter:", err)
+		}
+	}
+
+	job.finish(ResponseModel{
+		Status:        statusMsg,
+		Msg:           respMsg,
+		ExitCode:      cmdExitCode,
+		Signal:        signalName,
+		Cancelled:     isCancelled,
+		TimedOut:      isTimedOut,
+		LimitExceeded: limitExceeded,
+	})
+}
+
+// startTimeout - once the timeout expires the command gets a SIGTERM,
+// and if it's still running after the grace period, a SIGKILL.
+// The returned func stops the timers, it has to be called when the command finished.
+func (job *Job) startTimeout(timeout time.Duration) func() {
+	var killTimer *time.Timer
+	var timersMu sync.Mutex
+
+	termTimer := time.AfterFunc(timeout, func() {
+		job.mu.Lock()
+		job.isTimedOut = true
+		job.mu.Unlock()
+
+		log.Printf(" (!) Job %s timed out after %s, sending SIGTERM", job.ID, timeout)
+		if err := job.processGroup.Signal(syscall.SIGTERM); err != nil {
+			log.Printf(" [!] Job %s: failed to send SIGTERM: %s", job.ID, err)
+		}
+
+		timersMu.Lock()
+		defer timersMu.Unlock()
+		killTimer = time.AfterFunc(time.Duration(configServer.TimeoutGracePeriod), func() {
+			log.Printf(" (!) Job %s still running after the grace period, sending SIGKILL", job.ID)
+			if err := job.processGroup.Signal(syscall.SIGKILL); err != nil {
+				log.Printf(" [!] Job %s: failed to send SIGKILL: %s", job.ID, err)
+			}
+		})
+	})
+
+	return func() {
+		termTimer.Stop()
+		timersMu.Lock()
+		defer timersMu.Unlock()
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}
+}
+
+func (job *Job) finish(result ResponseModel) {
+	job.mu.Lock()
+	job.state = jobStateFinished
+	job.finishedAt = time.Now()
+	job.result = result
+	isStdinTaken := job.isStdinTaken
+	job.mu.Unlock()
+
+	if job.pty != nil {
+		if err := job.pty.Close(); err != nil {
+			log.Printf(" [!] Job %s: failed to close pty: %s", job.ID, err)
+		}
+	}
+	if job.stdinReader != nil {
+		// once the read end is closed a pending stdin write fails, instead of blocking forever
+		if err := job.stdinReader.Close(); err != nil {
+			log.Printf(" [!] Job %s: failed to close stdin: %s", job.ID, err)
+		}
+		if !isStdinTaken {
+			if err := job.stdinWriter.Close(); err != nil {
+				log.Printf(" [!] Job %s: failed to close stdin: %s", job.ID, err)
+			}
+		}
+	}
+
+	log.Printf(" (i) Job %s finished", job.ID)
+	close(job.done)
+}
+
+// JobManager ...
+// Runs at most maxConcurrentJobs jobs at the same time, the other jobs wait in a FIFO queue.
+type JobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// maxConcurrentJobs, maxQueuedJobs - 0 means no limit
+	maxConcurrentJobs int
+	maxQueuedJobs     int
+	runningCount      int
+	queue             []*Job
+}
+
+// NewJobManager ...
+// maxConcurrentJobs, maxQueuedJobs: 0 means no limit
+func NewJobManager(maxConcurrentJobs, maxQueuedJobs int) *JobManager {
+	return &JobManager{
+		jobs:              map[string]*Job{},
+		maxConcurrentJobs: maxConcurrentJobs,
+		maxQueuedJobs:     maxQueuedJobs,
+	}
+}
+
+// Submit ...
+// Registers the job and starts it in the background - or queues it, if there's no free slot.
+// If the queue is full (or the job can't be queued: NoQueue) the job is finished
+// right away, and errJobQueueFull / errNoFreeSlot is returned.
+// onAccepted (optional) is called once the job is accepted, before it's started.
+func (m *JobManager) Submit(job *Job, onAccepted func()) error {
+	m.mu.Lock()
+	m.removeExpiredJobs()
+	hasFreeSlot := m.maxConcurrentJobs == 0 || m.runningCount < m.maxConcurrentJobs
+	if !hasFreeSlot {
+		var err error
+		if job.Command.NoQueue {
+			err = errNoFreeSlot
+		} else if m.maxQueuedJobs > 0 && len(m.queue) >= m.maxQueuedJobs {
+			err = errJobQueueFull
+		}
+		if err != nil {
+			m.mu.Unlock()
+			log.Printf(" [!] Job %s rejected: %s", job.ID, err)
+			job.finish(createErrorResponseModel(err.Error(), 1))
+			return err
+		}
+	}
+
+	m.jobs[job.ID] = job
+	if hasFreeSlot {
+		m.runningCount++
+	} else {
+		m.queue = append(m.queue, job)
+		job.setQueuePosition(len(m.queue))
+		log.Printf(" (i) Job %s queued, position: %d", job.ID, len(m.queue))
+	}
+	m.mu.Unlock()
+
+	if onAccepted != nil {
+		onAccepted()
+	}
+	go m.runJob(job, !hasFreeSlot)
+	return nil
+}
+
+// runJob waits for a free slot (if the job is queued), runs the job,
+// and adds its record to the job history
+func (m *JobManager) runJob(job *Job, isQueued bool) {
+	defer func() { serverJobHistory.Add(job.Record()) }()
+
+	if isQueued && !m.waitForSlot(job) {
+		// cancelled while it was queued, run() finishes it right away
+		job.run()
+		return
+	}
+	defer m.releaseSlot()
+	job.run()
+}
+
+// waitForSlot waits until the queued job gets a slot, sends its queue position
+// (in a queued frame, if it has a stream) whenever it changes.
+// Returns false if the job was cancelled (and removed from the queue) before it got a slot.
+func (m *JobManager) waitForSlot(job *Job) bool {
+	lastSentPosition := 0
+	for {
+		job.mu.Lock()
+		position := job.queuePosition
+		job.mu.Unlock()
+		if job.streamEncoder != nil && position > 0 && position != lastSentPosition {
+			if err := job.streamEncoder.WriteFrame(StreamFrame{Type: streamFrameTypeQueued, QueuePosition: position}); err != nil {
+				vLogln("Failed to send queued frame:", err)
+			}
+			lastSentPosition = position
+		}
+
+		select {
+		case <-job.slotGranted:
+			return true
+		case <-job.queueUpdated:
+		case <-job.cancelChan:
+			if m.removeFromQueue(job) {
+				return false
+			}
+			// it got a slot in the meantime
+			<-job.slotGranted
+			return true
+		}
+	}
+}
+
+// releaseSlot - called when a job finished, starts the next queued job(s)
+func (m *JobManager) releaseSlot() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.runningCount--
+	for len(m.queue) > 0 && (m.maxConcurrentJobs == 0 || m.runningCount < m.maxConcurrentJobs) {
+		job := m.queue[0]
+		m.queue = m.queue[1:]
+		m.runningCount++
+		job.setQueuePosition(0)
+		close(job.slotGranted)
+	}
+	m.updateQueuePositions()
+}
+
+// removeFromQueue - false if the job is not in the queue
+func (m *JobManager) removeFromQueue(job *Job) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for idx, aJob := range m.queue {
+		if aJob == job {
+			m.queue = append(m.queue[:idx], m.queue[idx+1:]...)
+			job.setQueuePosition(0)
+			m.updateQueuePositions()
+			return true
+		}
+	}
+	return false
+}
+
+// updateQueuePositions - m.mu has to be locked by the caller
+func (m *JobManager) updateQueuePositions() {
+	for idx, job := range m.queue {
+		job.setQueuePosition(idx + 1)
+	}
+}
+
+func (job *Job) setQueuePosition(position int) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.queuePosition == position {
+		return
+	}
+	job.queuePosition = position
+	select {
+	case job.queueUpdated <- struct{}{}:
+	default:
+		// there's already a pending update
+	}
+}
+
+// Get ...
+func (m *JobManager) Get(jobID string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, found := m.jobs[jobID]
+	return job, found
+}
+
+// Counts ...
+// The number of the running and the queued jobs.
+func (m *JobManager) Counts() (runningCount, queuedCount int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.runningCount, len(m.queue)
+}
+
+// Records ...
+// The records of the jobs the manager knows about (including the recently finished ones).
+func (m *JobManager) Records() []JobRecordModel {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, aJob := range m.jobs {
+		jobs = append(jobs, aJob)
+	}
+	m.mu.Unlock()
+
+	records := []JobRecordModel{}
+	for _, aJob := range jobs {
+		records = append(records, aJob.Record())
+	}
+	return records
+}
+
+// removeExpiredJobs - m.mu has to be locked by the caller
+func (m *JobManager) removeExpiredJobs() {
+	for jobID, job := range m.jobs {
+		job.mu.Lock()
+		isExpired := job.state == jobStateFinished && time.Since(job.finishedAt) > configFinishedJobRetention
+		job.mu.Unlock()
+		if isExpired {
+			delete(m.jobs, jobID)
+		}
+	}
+}
+
+func generateJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
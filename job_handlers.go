@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	configDefaultJobWaitTimeout = 30 * time.Second
+	configMaxJobWaitTimeout     = 5 * time.Minute
+)
+
+func respondWithError(w http.ResponseWriter, statusCode int, errorMessage string) {
+	resp := createErrorResponseModel(errorMessage, 1)
+	if err := respondWithJSONStatus(w, statusCode, resp); err != nil {
+		log.Printf("Failed to respond with JSON: %#v", resp)
+	}
+}
+
+// jobsHandler handles: POST /jobs and GET /jobs
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		jobListHandler(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		respondWithError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method not allowed: %s", r.Method))
+		return
+	}
+
+	log.Println(" (i) Job submit received")
+	if clientName := requestClientName(r); clientName != "" {
+		log.Println(" (i) Client:", clientName)
+	}
+
+	cmdToRun, err := readCommandModel(r)
+	if err != nil {
+		serverMetrics.CountRequestFailure(requestFailureInvalid)
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s", err))
+		return
+	}
+
+	if denial := checkCommandPolicy(r, cmdToRun); denial != nil {
+		serverMetrics.CountRequestFailure(requestFailurePolicyDenied)
+		resp := createPolicyDenialResponseModel(denial)
+		if err := respondWithJSONStatus(w, http.StatusForbidden, resp); err != nil {
+			log.Printf("Failed to respond with JSON: %#v", resp)
+		}
+		return
+	}
+
+	job, err := NewJob(cmdToRun, requestClientName(r), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create job: %s", err))
+		return
+	}
+	if err := serverJobManager.Submit(job, nil); err != nil {
+		serverMetrics.CountRequestFailure(requestFailureServerBusy)
+		respondWithServerBusy(w, err)
+		return
+	}
+
+	if err := respondWithJSONStatus(w, http.StatusAccepted, job.Status()); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// jobListHandler lists the jobs (the newest first), with the filters of the query params,
+// see parseJobRecordFilter
+func jobListHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseJobRecordFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s", err))
+		return
+	}
+	// the clients can only list their own jobs, except the admin clients
+	if clientName := requestClientName(r); !isAdminClient(clientName) {
+		filter.Owner = &clientName
+	}
+
+	jobList := JobListModel{Jobs: serverJobHistory.List(filter, serverJobManager.Records())}
+	if err := respondWithJSONStatus(w, http.StatusOK, jobList); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// jobHandler handles: GET /jobs/{id}, GET /jobs/{id}/wait, POST /jobs/{id}/cancel,
+// POST /jobs/{id}/stdin, POST /jobs/{id}/resize and GET /jobs/{id}/log
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	pathComponents := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	jobID := pathComponents[0]
+	action := ""
+	if len(pathComponents) > 1 {
+		action = strings.Join(pathComponents[1:], "/")
+	}
+
+	job, found := serverJobManager.Get(jobID)
+	if found && !isJobAccessible(r, job.ClientName) {
+		// the same as a job which doesn't exist, the job IDs of the other clients are not revealed
+		job, found = nil, false
+	}
+	if action == "log" && r.Method == "GET" {
+		// job is nil if the server doesn't know about the job anymore, its log is still available
+		if !found && !isJobLogAccessible(r, jobID) {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Job not found: %s", jobID))
+			return
+		}
+		jobLogHandler(w, r, jobID, job)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Job not found: %s", jobID))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		jobStatusHandler(w, r, job)
+	case action == "wait" && r.Method == "GET":
+		jobWaitHandler(w, r, job)
+	case action == "cancel" && r.Method == "POST":
+		jobCancelHandler(w, r, job)
+	case action == "stdin" && r.Method == "POST":
+		jobStdinHandler(w, r, job)
+	case action == "resize" && r.Method == "POST":
+		jobResizeHandler(w, r, job)
+	default:
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Not found: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// isJobLogAccessible - the log of a job the server doesn't know about anymore: the job's client
+// is looked up in the job history, if it's not in the history either only an admin client can access it
+func isJobLogAccessible(r *http.Request, jobID string) bool {
+	if record, found := serverJobHistory.Get(jobID); found {
+		return isJobAccessible(r, record.Client)
+	}
+	return isAdminClient(requestClientName(r))
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request, job *Job) {
+	if err := respondWithJSONStatus(w, http.StatusOK, job.Status()); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// jobWaitHandler waits until the job is finished, or until the timeout
+// (query param, in seconds) is reached, then returns the job's status.
+// The client should check the state and wait again if it's not finished yet.
+func jobWaitHandler(w http.ResponseWriter, r *http.Request, job *Job) {
+	timeout := configDefaultJobWaitTimeout
+	if timeoutParam := r.URL.Query().Get("timeout"); timeoutParam != "" {
+		timeoutSec, err := strconv.Atoi(timeoutParam)
+		if err != nil || timeoutSec < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid timeout: %s", timeoutParam))
+			return
+		}
+		timeout = time.Duration(timeoutSec) * time.Second
+	}
+	if timeout > configMaxJobWaitTimeout {
+		timeout = configMaxJobWaitTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-job.Done():
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	if err := respondWithJSONStatus(w, http.StatusOK, job.Status()); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// jobCancelHandler sends a signal (query param, default: TERM) to the job's process group
+func jobCancelHandler(w http.ResponseWriter, r *http.Request, job *Job) {
+	sig := syscall.SIGTERM
+	if signalParam := r.URL.Query().Get("signal"); signalParam != "" {
+		var err error
+		sig, err = ParseSignal(signalParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s", err))
+			return
+		}
+	}
+
+	if err := job.Cancel(sig); err != nil {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Failed to cancel job: %s", err))
+		return
+	}
+
+	if err := respondWithJSONStatus(w, http.StatusOK, job.Status()); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// jobStdinHandler streams the request's body into the command's stdin,
+// the end of the body means EOF for the command
+func jobStdinHandler(w http.ResponseWriter, r *http.Request, job *Job) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Println(" [!] Failed to close r.Body:", err)
+		}
+	}()
+
+	stdinWriter, err := job.TakeStdinWriter()
+	if err != nil {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("%s", err))
+		return
+	}
+
+	writtenBytes, copyErr := io.Copy(stdinWriter, r.Body)
+	if err := stdinWriter.Close(); err != nil {
+		log.Printf(" [!] Job %s: failed to close stdin: %s", job.ID, err)
+	}
+	log.Printf(" (i) Job %s: %d byte(s) written to stdin", job.ID, writtenBytes)
+
+	if copyErr != nil {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Failed to write stdin (after %d bytes): %s", writtenBytes, copyErr))
+		return
+	}
+
+	respModel := ResponseModel{
+		Status:   configOkStatusMsg,
+		Msg:      fmt.Sprintf("%d byte(s) written to stdin", writtenBytes),
+		ExitCode: 0,
+	}
+	if err := respondWithJSON(w, respModel); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// jobResizeHandler resizes the job's pseudo-terminal, the request's body is a TerminalSizeModel
+func jobResizeHandler(w http.ResponseWriter, r *http.Request, job *Job) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			log.Println(" [!] Failed to close r.Body:", err)
+		}
+	}()
+
+	var size TerminalSizeModel
+	if err := json.NewDecoder(r.Body).Decode(&size); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %s", err))
+		return
+	}
+	if size.Rows == 0 || size.Cols == 0 {
+		respondWithError(w, http.StatusBadRequest, "Both rows and cols have to be specified")
+		return
+	}
+
+	if err := job.Resize(size); err != nil {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Failed to resize: %s", err))
+		return
+	}
+
+	if err := respondWithJSONStatus(w, http.StatusOK, job.Status()); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// configJobLogCleanupInterval - how often the logs older than log_retention are removed
+	configJobLogCleanupInterval = 1 * time.Hour
+	// configJobLogFollowPollInterval - how often a followed log is checked for new output
+	configJobLogFollowPollInterval = 250 * time.Millisecond
+
+	jobIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// jobLogFilePath - the job's log in the server's log_directory, empty if there's no log_directory
+func jobLogFilePath(jobID string) string {
+	if configServer.LogDirectory == "" || !jobIDPattern.MatchString(jobID) {
+		return ""
+	}
+	return filepath.Join(configServer.LogDirectory, jobID+".log")
+}
+
+// cappedFileWriter writes into the file until it reaches maxSize (0 means no limit),
+// then writes a note about the truncation, and drops the rest of the output.
+// It never fails the write, the command shouldn't fail because of its log.
+type cappedFileWriter struct {
+	mu          sync.Mutex
+	file        *os.File
+	maxSize     int64
+	size        int64
+	isTruncated bool
+	writeErr    error
+}
+
+func (w *cappedFileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.isTruncated || w.writeErr != nil {
+		return len(p), nil
+	}
+	data := p
+	if w.maxSize > 0 && w.size+int64(len(data)) > w.maxSize {
+		data = data[:w.maxSize-w.size]
+		w.isTruncated = true
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		w.writeErr = err
+		log.Printf(" [!] Failed to write job log (%s): %s", w.file.Name(), err)
+		return len(p), nil
+	}
+	if w.isTruncated {
+		if _, err := fmt.Fprintf(w.file, "\n[cmd-bridge: the log reached its size limit (%d bytes), the rest of the output is not logged]\n", w.maxSize); err != nil {
+			w.writeErr = err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *cappedFileWriter) Close() error {
+	return w.file.Close()
+}
+
+// StartJobLogCleanup removes the job logs older than the retention periodically,
+// retention: 0 means the logs are kept forever
+func StartJobLogCleanup(directory string, retention time.Duration) {
+	if directory == "" || retention <= 0 {
+		return
+	}
+	removeExpiredJobLogs(directory, retention)
+	go func() {
+		for range time.Tick(configJobLogCleanupInterval) {
+			removeExpiredJobLogs(directory, retention)
+		}
+	}()
+}
+
+// removeExpiredJobLogs - only the job logs (JOB_ID.log) are removed, based on their last modification
+func removeExpiredJobLogs(directory string, retention time.Duration) {
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		log.Println(" [!] Failed to read log directory:", err)
+		return
+	}
+	expiry := time.Now().Add(-retention)
+	removedCount := 0
+	for _, aFileInfo := range fileInfos {
+		if aFileInfo.IsDir() || !strings.HasSuffix(aFileInfo.Name(), ".log") ||
+			!jobIDPattern.MatchString(strings.TrimSuffix(aFileInfo.Name(), ".log")) || !aFileInfo.ModTime().Before(expiry) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(directory, aFileInfo.Name())); err != nil {
+			log.Println(" [!] Failed to remove expired job log:", err)
+			continue
+		}
+		removedCount++
+	}
+	if removedCount > 0 {
+		log.Printf(" (i) Removed %d expired job log(s)", removedCount)
+	}
+}
+
+// jobLogHandler handles: GET /jobs/{id}/log - the job's log from the server's log_directory.
+// Query params: offset (start from this byte), tail (start from the last N lines),
+// follow (true: keep sending the new output until the job finishes).
+// The X-Log-Offset header is the offset the returned log starts at.
+// job is nil if the server doesn't know about the job anymore (e.g. after a restart), its log can still be read.
+func jobLogHandler(w http.ResponseWriter, r *http.Request, jobID string, job *Job) {
+	logFilePath := jobLogFilePath(jobID)
+	if logFilePath == "" {
+		if configServer.LogDirectory == "" {
+			respondWithError(w, http.StatusNotFound, "Job logs are not stored, the server has no log_directory")
+		} else {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Job not found: %s", jobID))
+		}
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("offset") != "" && query.Get("tail") != "" {
+		respondWithError(w, http.StatusBadRequest, "Only one of offset and tail can be specified")
+		return
+	}
+	isFollow := false
+	if followParam := query.Get("follow"); followParam != "" {
+		var err error
+		if isFollow, err = strconv.ParseBool(followParam); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid follow: %s", followParam))
+			return
+		}
+	}
+
+	file, err := os.Open(logFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("No log found for job: %s", jobID))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to open job log: %s", err))
+		}
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(" [!] Failed to close job log:", err)
+		}
+	}()
+
+	offset := int64(0)
+	if offsetParam := query.Get("offset"); offsetParam != "" {
+		if offset, err = strconv.ParseInt(offsetParam, 10, 64); err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid offset: %s", offsetParam))
+			return
+		}
+	}
+	if tailParam := query.Get("tail"); tailParam != "" {
+		lineCount, err := strconv.Atoi(tailParam)
+		if err != nil || lineCount < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid tail: %s", tailParam))
+			return
+		}
+		if offset, err = tailOffset(file, lineCount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read job log: %s", err))
+			return
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read job log: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Log-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, file); err != nil {
+		vLogln("Failed to send job log:", err)
+		return
+	}
+	if !isFollow || job == nil {
+		return
+	}
+
+	flusher, isFlusher := w.(http.Flusher)
+	for {
+		if isFlusher {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-job.Done():
+			// the output written since the last read
+			if _, err := io.Copy(w, file); err != nil {
+				vLogln("Failed to send job log:", err)
+			}
+			return
+		case <-time.After(configJobLogFollowPollInterval):
+		}
+		if _, err := io.Copy(w, file); err != nil {
+			vLogln("Failed to send job log:", err)
+			return
+		}
+	}
+}
+
+// tailOffset returns the offset of the file's last lineCount lines
+// (a last line without a trailing new line counts as a line)
+func tailOffset(file *os.File, lineCount int) (int64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fileInfo.Size()
+	if lineCount == 0 {
+		return size, nil
+	}
+
+	const chunkSize = 32 * 1024
+	buf := make([]byte, chunkSize)
+	newLineCount := 0
+	end := size
+	for end > 0 {
+		start := end - chunkSize
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for idx := len(chunk) - 1; idx >= 0; idx-- {
+			if chunk[idx] != '\n' || start+int64(idx) == size-1 {
+				// the file's trailing new line closes the last line, it doesn't start a new one
+				continue
+			}
+			newLineCount++
+			if newLineCount == lineCount {
+				return start + int64(idx) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// execHelperArg - the server runs itself with this (first) argument to start a command
+// with resource limits, nice level or CPU affinity: the helper applies them, then replaces itself with the command
+const execHelperArg = "__exec-with-limits"
+
+// configCPUTimeLimitGracePeriod - the command gets a SIGXCPU when it reaches its CPU time limit,
+// and a SIGKILL if it's still running after this much more CPU time
+var configCPUTimeLimitGracePeriod = 5 * time.Second
+
+const (
+	limitCPUTime      = "cpu_time"
+	limitAddressSpace = "address_space"
+	limitOpenFiles    = "open_files"
+	limitProcesses    = "processes"
+	limitCoreSize     = "core_size"
+	// limitFileSize, limitMemory - only reported, can't be set per command
+	limitFileSize = "file_size"
+	limitMemory   = "memory"
+)
+
+// CommandLimitsModel ...
+// Resource limits (rlimits) of the command, capped by the server's max_* config.
+// The limits apply to each process of the command separately (except processes).
+type CommandLimitsModel struct {
+	// CPUTime - in seconds
+	CPUTime int `json:"cpu_time,omitempty"`
+	// AddressSpaceMB - virtual memory, in megabytes
+	AddressSpaceMB int `json:"address_space_mb,omitempty"`
+	OpenFiles      int `json:"open_files,omitempty"`
+	// Processes - the number of processes of the command's user (not only the command's processes),
+	// not enforced for root
+	Processes int `json:"processes,omitempty"`
+	// CoreSizeMB - max core dump size in megabytes, 0 disables core dumps (that's why it's a pointer)
+	CoreSizeMB *int `json:"core_size_mb,omitempty"`
+}
+
+// execHelperSpecModel - what the exec helper applies before it starts the command
+type execHelperSpecModel struct {
+	Rlimits []execHelperRlimitModel `json:"rlimits,omitempty"`
+	Nice    int                     `json:"nice,omitempty"`
+	CPUs    []int                   `json:"cpus,omitempty"`
+	// Credential - the helper runs with the server's credentials (the command's user might not be
+	// able to run the cmd-bridge executable), and switches to the command's user after the limits are applied.
+	// Dir - the command's working directory, the helper changes into it with the command's user.
+	Credential *syscall.Credential `json:"credential,omitempty"`
+	Dir        string              `json:"dir,omitempty"`
+}
+
+type execHelperRlimitModel struct {
+	Name     string `json:"name"`
+	Resource int    `json:"resource"`
+	Soft     uint64 `json:"soft"`
+	Hard     uint64 `json:"hard"`
+}
+
+// cappedLimit - the requested limit, capped by the max (0 means no max),
+// if no limit is requested the max
+func cappedLimit(requested, max int) int {
+	if max > 0 && (requested <= 0 || requested > max) {
+		return max
+	}
+	return requested
+}
+
+// effectiveCommandLimits returns the command's limits, capped by the server's max_* config
+func effectiveCommandLimits(requested *CommandLimitsModel) CommandLimitsModel {
+	limits := CommandLimitsModel{}
+	if requested != nil {
+		limits = *requested
+	}
+
+	limits.CPUTime = cappedLimit(limits.CPUTime, int(time.Duration(configServer.MaxCPUTime)/time.Second))
+	limits.AddressSpaceMB = cappedLimit(limits.AddressSpaceMB, configServer.MaxAddressSpaceMB)
+	limits.OpenFiles = cappedLimit(limits.OpenFiles, configServer.MaxOpenFiles)
+	limits.Processes = cappedLimit(limits.Processes, configServer.MaxProcesses)
+	if configServer.MaxCoreSizeMB > 0 && (limits.CoreSizeMB == nil || *limits.CoreSizeMB > configServer.MaxCoreSizeMB) {
+		maxCoreSize := configServer.MaxCoreSizeMB
+		limits.CoreSizeMB = &maxCoreSize
+	}
+	return limits
+}
+
+// validateCommandLimits checks the command's limits, nice level and CPU affinity
+func validateCommandLimits(cmdToRun CommandModel) error {
+	if limits := cmdToRun.Limits; limits != nil {
+		if limits.CPUTime < 0 || limits.AddressSpaceMB < 0 || limits.OpenFiles < 0 || limits.Processes < 0 ||
+			(limits.CoreSizeMB != nil && *limits.CoreSizeMB < 0) {
+			return errors.New("Invalid limits: can't be negative")
+		}
+	}
+
+	if cmdToRun.Nice < -20 || cmdToRun.Nice > 19 {
+		return fmt.Errorf("Invalid nice: should be between -20 and 19, got: %d", cmdToRun.Nice)
+	}
+	if cmdToRun.Nice < configServer.MinNice {
+		return fmt.Errorf("Invalid nice: the server's min_nice is %d, got: %d", configServer.MinNice, cmdToRun.Nice)
+	}
+
+	if len(cmdToRun.CPUAffinity) > 0 && !isCPUAffinitySupported {
+		return errors.New("cpu_affinity is not supported on this platform")
+	}
+	for _, aCPU := range cmdToRun.CPUAffinity {
+		if aCPU < 0 || aCPU >= runtime.NumCPU() {
+			return fmt.Errorf("Invalid cpu_affinity: the server has %d CPUs (0-%d), got: %d", runtime.NumCPU(), runtime.NumCPU()-1, aCPU)
+		}
+	}
+	return nil
+}
+
+// commandExecHelperSpec - nil if the command has no limits, nice level or CPU affinity
+func commandExecHelperSpec(cmdToRun CommandModel) *execHelperSpecModel {
+	limits := effectiveCommandLimits(cmdToRun.Limits)
+	spec := execHelperSpecModel{Nice: cmdToRun.Nice, CPUs: cmdToRun.CPUAffinity}
+
+	addRlimit := func(name string, resource int, soft, hard uint64) {
+		spec.Rlimits = append(spec.Rlimits, execHelperRlimitModel{Name: name, Resource: resource, Soft: soft, Hard: hard})
+	}
+	if limits.CPUTime > 0 {
+		addRlimit(limitCPUTime, syscall.RLIMIT_CPU, uint64(limits.CPUTime), uint64(limits.CPUTime)+uint64(configCPUTimeLimitGracePeriod/time.Second))
+	}
+	if limits.AddressSpaceMB > 0 {
+		addRlimit(limitAddressSpace, syscall.RLIMIT_AS, uint64(limits.AddressSpaceMB)<<20, uint64(limits.AddressSpaceMB)<<20)
+	}
+	if limits.OpenFiles > 0 {
+		addRlimit(limitOpenFiles, syscall.RLIMIT_NOFILE, uint64(limits.OpenFiles), uint64(limits.OpenFiles))
+	}
+	if limits.Processes > 0 {
+		addRlimit(limitProcesses, rlimitNProc, uint64(limits.Processes), uint64(limits.Processes))
+	}
+	if limits.CoreSizeMB != nil {
+		addRlimit(limitCoreSize, syscall.RLIMIT_CORE, uint64(*limits.CoreSizeMB)<<20, uint64(*limits.CoreSizeMB)<<20)
+	}
+
+	if len(spec.Rlimits) == 0 && spec.Nice == 0 && len(spec.CPUs) == 0 {
+		return nil
+	}
+	return &spec
+}
+
+// wrapWithExecHelper returns the command and args which run the program through the exec helper
+func wrapWithExecHelper(spec execHelperSpecModel, command string, cmdArgs []string) (string, []string, error) {
+	helperPath, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to find the cmd-bridge executable: %s", err)
+	}
+	// a program name without a path is looked up in the PATH by the server, the same as a command
+	// without the helper would be. A path (e.g. ./build.sh) is passed as it is: the helper runs in the
+	// command's working directory, a relative path is resolved there.
+	programPath := command
+	if !strings.Contains(command, "/") {
+		programPath, err = exec.LookPath(command)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return "", nil, err
+	}
+	return helperPath, append([]string{execHelperArg, string(specBytes), programPath}, cmdArgs...), nil
+}
+
+// runExecHelper applies the spec, then replaces the process with the program,
+// returns only if it fails (with the exit code the process should exit with)
+func runExecHelper(args []string) int {
+	// nice and CPU affinity are set for the current thread on Linux,
+	// the program has to be started from the same thread
+	runtime.LockOSThread()
+
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "cmd-bridge: invalid exec helper arguments")
+		return 1
+	}
+	var spec execHelperSpecModel
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		fmt.Fprintln(os.Stderr, "cmd-bridge: invalid exec helper spec:", err)
+		return 1
+	}
+
+	for _, anRlimit := range spec.Rlimits {
+		if err := syscall.Setrlimit(anRlimit.Resource, &syscall.Rlimit{Cur: anRlimit.Soft, Max: anRlimit.Hard}); err != nil {
+			fmt.Fprintf(os.Stderr, "cmd-bridge: failed to set the %s limit: %s\n", anRlimit.Name, err)
+			return 1
+		}
+	}
+	if spec.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, spec.Nice); err != nil {
+			fmt.Fprintf(os.Stderr, "cmd-bridge: failed to set nice to %d: %s\n", spec.Nice, err)
+			return 1
+		}
+	}
+	if len(spec.CPUs) > 0 {
+		if err := setCPUAffinity(spec.CPUs); err != nil {
+			fmt.Fprintln(os.Stderr, "cmd-bridge: failed to set CPU affinity:", err)
+			return 1
+		}
+	}
+
+	if spec.Credential != nil {
+		if err := switchCredential(*spec.Credential); err != nil {
+			fmt.Fprintf(os.Stderr, "cmd-bridge: failed to switch to uid %d, gid %d: %s\n", spec.Credential.Uid, spec.Credential.Gid, err)
+			return 1
+		}
+	}
+	if spec.Dir != "" {
+		if err := os.Chdir(spec.Dir); err != nil {
+			fmt.Fprintln(os.Stderr, "cmd-bridge: failed to change the working directory:", err)
+			return 1
+		}
+	}
+
+	err := syscall.Exec(args[1], args[1:], os.Environ())
+	fmt.Fprintf(os.Stderr, "cmd-bridge: failed to start %s: %s\n", args[1], err)
+	return 127
+}
+
+// switchCredential sets the groups, then the gid and the uid of the process (all of its threads)
+func switchCredential(credential syscall.Credential) error {
+	if !credential.NoSetGroups {
+		groups := make([]int, len(credential.Groups))
+		for idx, aGid := range credential.Groups {
+			groups[idx] = int(aGid)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgid(int(credential.Gid)); err != nil {
+		return err
+	}
+	return syscall.Setuid(int(credential.Uid))
+}
+
+// exceededLimit returns which limit the command exceeded, if it was terminated because of one:
+// the CPU time limit, the file size limit (SIGXFSZ, the file size rlimit can't be set per command,
+// only inherited from the server) and the memory (the command got a SIGKILL and isOOMKillCounted:
+// the OOM killer killed a process while the command was running). Reaching the other limits makes
+// the system calls fail (e.g. allocating memory, opening a file), the command decides what to do then.
+// cpuTimeLimit is in seconds, 0 means no limit.
+func exceededLimit(err error, cpuTimeLimit int, isOOMKillCounted bool) string {
+	sig, isSignaled := terminatingSignal(err)
+	if !isSignaled {
+		return ""
+	}
+	switch sig {
+	case syscall.SIGXCPU:
+		if cpuTimeLimit > 0 {
+			return limitCPUTime
+		}
+	case syscall.SIGXFSZ:
+		return limitFileSize
+	case syscall.SIGKILL:
+		// if the command ignored the SIGXCPU it's killed when it reaches the hard limit
+		if exitErr, ok := err.(*exec.ExitError); ok && cpuTimeLimit > 0 {
+			cpuTime := exitErr.UserTime() + exitErr.SystemTime()
+			if cpuTime >= time.Duration(cpuTimeLimit)*time.Second {
+				return limitCPUTime
+			}
+		}
+		if isOOMKillCounted {
+			return limitMemory
+		}
+	}
+	return ""
+}
+
+// parseCPUList parses comma separated CPU numbers and ranges, e.g. 0,2-3
+func parseCPUList(items []string) ([]int, error) {
+	cpus := []int{}
+	for _, anItem := range items {
+		for _, aPart := range strings.Split(anItem, ",") {
+			aPart = strings.TrimSpace(aPart)
+			if aPart == "" {
+				continue
+			}
+			bounds := strings.SplitN(aPart, "-", 2)
+			first, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid CPU number: %s", aPart)
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+					return nil, fmt.Errorf("invalid CPU range: %s", aPart)
+				}
+			}
+			for aCPU := first; aCPU <= last; aCPU++ {
+				cpus = append(cpus, aCPU)
+			}
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, nil
+	}
+	return cpus, nil
+}
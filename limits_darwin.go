@@ -0,0 +1,18 @@
+package main
+
+import "errors"
+
+// rlimitNProc - RLIMIT_NPROC, not defined in the syscall package
+const rlimitNProc = 7
+
+// there's no CPU affinity on macOS (only affinity tags, which are just hints)
+const isCPUAffinitySupported = false
+
+func setCPUAffinity(cpus []int) error {
+	return errors.New("not supported on macOS")
+}
+
+// oomKillCount - there's no OOM kill counter on macOS
+func oomKillCount() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitNProc - RLIMIT_NPROC, not defined in the syscall package
+const rlimitNProc = 6
+
+const isCPUAffinitySupported = true
+
+// setCPUAffinity restricts the current thread to the CPUs
+func setCPUAffinity(cpus []int) error {
+	var mask [1024 / 64]uint64
+	for _, aCPU := range cpus {
+		if aCPU >= len(mask)*64 {
+			return fmt.Errorf("CPU number too high: %d", aCPU)
+		}
+		mask[aCPU/64] |= 1 << uint(aCPU%64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// oomKillCount - the number of processes the OOM killer killed since the system started
+// (including the kills because of a cgroup's memory limit), false if it's not available
+func oomKillCount() (uint64, bool) {
+	vmstatBytes, err := ioutil.ReadFile("/proc/vmstat")
+	if err != nil {
+		return 0, false
+	}
+	for _, aLine := range strings.Split(string(vmstatBytes), "\n") {
+		fields := strings.Fields(aLine)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.ParseUint(fields[1], 10, 64)
+			return count, err == nil
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWrapWithExecHelperProgramPath(t *testing.T) {
+	lsPath, err := exec.LookPath("ls")
+	if err != nil {
+		t.Skip("ls not found in PATH")
+	}
+
+	for _, tc := range []struct {
+		command     string
+		wantProgram string
+	}{
+		{command: "ls", wantProgram: lsPath},
+		{command: "./build.sh", wantProgram: "./build.sh"},
+		{command: "scripts/build.sh", wantProgram: "scripts/build.sh"},
+		{command: "/bin/sh", wantProgram: "/bin/sh"},
+	} {
+		_, helperArgs, err := wrapWithExecHelper(execHelperSpecModel{Nice: 5}, tc.command, []string{"arg"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.command, err)
+			continue
+		}
+		if len(helperArgs) != 4 || helperArgs[0] != execHelperArg || helperArgs[2] != tc.wantProgram || helperArgs[3] != "arg" {
+			t.Errorf("%s: got helper args %q, want program %s", tc.command, helperArgs, tc.wantProgram)
+		}
+	}
+}
+
+// a relative program path is resolved in the command's working directory, with or without the exec helper
+func TestExecuteCommandRelativeProgramWithLimits(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+
+	workDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(workDir, "x.sh"), []byte("#!/bin/sh\necho \"ran in $(pwd)\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resolvedWorkDir, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		cmdToRun    CommandModel
+		serverLimit int
+	}{
+		{name: "no limits", cmdToRun: CommandModel{Args: []string{"./x.sh"}}},
+		{name: "nice", cmdToRun: CommandModel{Args: []string{"./x.sh"}, Nice: 5}},
+		{name: "open files limit", cmdToRun: CommandModel{Args: []string{"./x.sh"}, Limits: &CommandLimitsModel{OpenFiles: 100}}},
+		{name: "server max_open_files", cmdToRun: CommandModel{Args: []string{"./x.sh"}}, serverLimit: 100},
+	} {
+		configServer = defaultServerConfig()
+		configServer.MaxOpenFiles = tc.serverLimit
+		tc.cmdToRun.WorkingDirectory = workDir
+
+		exitCode, output, err := executeTestCommand(t, tc.cmdToRun)
+		if err != nil || exitCode != 0 {
+			t.Errorf("%s: exit code: %d, error: %v, output: %s", tc.name, exitCode, err, output)
+			continue
+		}
+		if !strings.Contains(output, "ran in "+resolvedWorkDir) {
+			t.Errorf("%s: unexpected output: %s", tc.name, output)
+		}
+	}
+}
+
+// the exec helper switches to the command's user itself, the user doesn't need to be able to run
+// the cmd-bridge executable (the test binary is in a directory only root can access)
+func TestExecuteCommandAsAnotherUserWithLimits(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	exitCode, output, err := executeTestCommand(t, CommandModel{
+		Args:             []string{"id", "-u"},
+		User:             "nobody",
+		Nice:             5,
+		WorkingDirectory: "/",
+	})
+	if err != nil || exitCode != 0 {
+		t.Fatalf("exit code: %d, error: %v, output: %s", exitCode, err, output)
+	}
+	if strings.TrimSpace(output) != nobody.Uid {
+		t.Errorf("expected to run as uid %s, output: %s", nobody.Uid, output)
+	}
+}
+
+func TestExceededLimitFileSize(t *testing.T) {
+	exitCode, output, err := executeTestCommand(t, CommandModel{
+		Command:      "ulimit -f 1 && exec head -c 4096 /dev/zero > \"$TMPDIR/big\"",
+		Environments: []EnvironmentKeyValue{{Key: "TMPDIR", Value: t.TempDir()}},
+		Login:        new(bool),
+	})
+	if err == nil {
+		t.Fatalf("expected the command to fail, exit code: %d, output: %s", exitCode, output)
+	}
+	if limit := exceededLimit(err, 0, false); limit != limitFileSize {
+		t.Errorf("expected %q limit, got %q (error: %s)", limitFileSize, limit, err)
+	}
+	if limit := exceededLimit(err, 10, true); limit != limitFileSize {
+		t.Errorf("expected %q limit with an OOM kill counted, got %q", limitFileSize, limit)
+	}
+}
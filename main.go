@@ -2,21 +2,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/hpcloud/tail"
 	_ "golang.org/x/sys/unix"
 )
 
 var (
-	configServerPort       = "27473"
+	// configServerURL - the URL of the server to send commands to (non-server mode)
+	configServerURL = "http://localhost:27473"
+
 	configOkStatusMsg      = "ok"
 	configErrorStatusMsg   = "error"
 	configCommandEnvPrefix = "_CMDENV__"
@@ -30,8 +37,15 @@ func usage() {
 	fmt.Println("\nIf a command parameter is specified cmd-bridge will try to connect")
 	fmt.Println("to an already running cmd-bridge server and execute the specified")
 	fmt.Println("command through it.")
+	fmt.Println("\nThe run command runs the program with the exact arguments specified")
+	fmt.Println("after it (e.g. run -- ls -la \"my dir\"), without a shell interpreting them.")
+	fmt.Println("\n## Interactive session")
+	fmt.Println("\nThe attach-shell command connects the terminal to a login shell")
+	fmt.Println("(or to the -do command) running in a pseudo-terminal, through the cmd-bridge server.")
+	fmt.Println("\n## Job history")
+	fmt.Println("\nThe jobs command lists the server's jobs (the newest first), see the [jobs] flags for the filters.")
 	fmt.Println("\n# Available parameters / flags:")
-	fmt.Printf("\nUsage: %s [FLAGS]\n", os.Args[0])
+	fmt.Printf("\nUsage: %s [FLAGS] [run [FLAGS] -- PROGRAM [ARGS...] | attach-shell [FLAGS] | jobs [FLAGS]]\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -40,6 +54,14 @@ type ResponseModel struct {
 	Status   string `json:"status"`
 	Msg      string `json:"msg"`
 	ExitCode int    `json:"exit_code"`
+	// Signal is the name of the signal which terminated the command (if it was terminated by one)
+	Signal    string `json:"signal,omitempty"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	// LimitExceeded - the resource limit (e.g. cpu_time) the command was terminated for
+	LimitExceeded string `json:"limit_exceeded,omitempty"`
+	// PolicyDenial - why the command was denied, if it was denied by the command policy
+	PolicyDenial *PolicyDenialModel `json:"policy_denial,omitempty"`
 }
 
 //
@@ -54,19 +76,34 @@ func createErrorResponseModel(errorMessage string, exitCode int) ResponseModel {
 }
 
 func respondWithJSON(w http.ResponseWriter, respModel ResponseModel) error {
-	w.Header().Set("Content Type", "application/json")
 	if respModel.Status == configOkStatusMsg {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
+		return respondWithJSONStatus(w, http.StatusOK, respModel)
 	}
+	return respondWithJSONStatus(w, http.StatusBadRequest, respModel)
+}
+
+func respondWithJSONStatus(w http.ResponseWriter, statusCode int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 
-	log.Printf("=> Response: %#v\n", respModel)
+	log.Printf("=> Response: %#v\n", v)
 
-	err := json.NewEncoder(w).Encode(&respModel)
+	err := json.NewEncoder(w).Encode(v)
 	return err
 }
 
+// respondWithServerBusy - 429, for a job rejected by the JobManager
+func respondWithServerBusy(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(configQueueFullRetryAfter/time.Second)))
+	respondWithError(w, http.StatusTooManyRequests, err.Error())
+}
+
+func respondWithStreamResult(enc *frameEncoder, respModel ResponseModel) error {
+	log.Printf("=> Response (stream): %#v\n", respModel)
+
+	return enc.WriteFrame(StreamFrame{Type: streamFrameTypeResult, Response: &respModel})
+}
+
 func pingHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(" (i) Ping received")
 
@@ -82,9 +119,8 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func commandHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(" (i) Command received")
-
+// readCommandModel reads the CommandModel from the request's JSON body
+func readCommandModel(r *http.Request) (CommandModel, error) {
 	defer func() {
 		if err := r.Body.Close(); err != nil {
 			log.Println(" [!] Failed to close r.Body:", err)
@@ -92,67 +128,132 @@ func commandHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		resp := createErrorResponseModel(
-			fmt.Sprintf("Failed to ready Request Body: %s", err),
-			1,
-		)
+		return CommandModel{}, fmt.Errorf("Failed to ready Request Body: %s", err)
+	}
+
+	// the raw body is not logged, the environment variable values might be secrets
+	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+	var cmdToRun CommandModel
+	if err := decoder.Decode(&cmdToRun); err != nil {
+		return CommandModel{}, fmt.Errorf("Invalid JSON: %s", err)
+	}
+	if err := validateCommandModel(cmdToRun); err != nil {
+		return CommandModel{}, err
+	}
+	fmt.Printf("Command to run: %#v\n", commandModelForLog(cmdToRun))
+
+	return cmdToRun, nil
+}
+
+// validateCommandModel checks the command's options, and whether it's allowed to run
+func validateCommandModel(cmdToRun CommandModel) error {
+	if len(cmdToRun.Args) > 0 {
+		if cmdToRun.Command != "" {
+			return errors.New("Only one of command and args can be specified")
+		}
+		if cmdToRun.Args[0] == "" {
+			return errors.New("Invalid args: the program (first item) can't be empty")
+		}
+		if cmdToRun.Shell != "" || cmdToRun.Login != nil {
+			return errors.New("shell and login can't be specified with args, there's no shell involved")
+		}
+	} else if _, err := resolveCommandShell(cmdToRun.Shell); err != nil {
+		return err
+	}
+	if err := validateCommandEnvOptions(cmdToRun); err != nil {
+		return err
+	}
+	if cmdToRun.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout: %d", cmdToRun.Timeout)
+	}
+	if cmdToRun.LogFormat != "" && cmdToRun.LogFormat != logFormatRaw && cmdToRun.LogFormat != logFormatNDJSON {
+		return fmt.Errorf("Invalid log format: %s", cmdToRun.LogFormat)
+	}
+	if cmdToRun.LogFilePath != "" {
+		if _, err := resolveLogFilePath(cmdToRun.LogFilePath); err != nil {
+			return err
+		}
+	}
+	if cmdToRun.TTYSize != nil && (cmdToRun.TTYSize.Rows == 0 || cmdToRun.TTYSize.Cols == 0) {
+		return errors.New("Invalid tty_size: both rows and cols have to be specified")
+	}
+	if _, err := resolveCommandIdentity(cmdToRun.User, cmdToRun.Group); err != nil {
+		return err
+	}
+	if err := validateCommandLimits(cmdToRun); err != nil {
+		return err
+	}
+	return checkWorkingDirectoryAllowed(cmdToRun.WorkingDirectory)
+}
+
+// commandHandler runs the command as a job and waits for it to finish
+func commandHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(" (i) Command received")
+	if clientName := requestClientName(r); clientName != "" {
+		log.Println(" (i) Client:", clientName)
+	}
+
+	cmdToRun, err := readCommandModel(r)
+	if err != nil {
+		serverMetrics.CountRequestFailure(requestFailureInvalid)
+		resp := createErrorResponseModel(fmt.Sprintf("%s", err), 1)
 		if err := respondWithJSON(w, resp); err != nil {
 			log.Printf("Failed to respond with JSON: %#v", resp)
 		}
 		return
 	}
 
-	bodyString := string(bodyBytes)
-	log.Println(" (i) Raw request body: ", bodyString)
-
-	// queryValues := r.URL.Query()
-	// decoder := json.NewDecoder(r.Body)
-	decoder := json.NewDecoder(strings.NewReader(bodyString))
-	var cmdToRun CommandModel
-	if err := decoder.Decode(&cmdToRun); err != nil {
-		resp := createErrorResponseModel(
-			fmt.Sprintf("Invalid JSON: %s", err),
-			1,
-		)
-		if err := respondWithJSON(w, resp); err != nil {
+	if denial := checkCommandPolicy(r, cmdToRun); denial != nil {
+		serverMetrics.CountRequestFailure(requestFailurePolicyDenied)
+		resp := createPolicyDenialResponseModel(denial)
+		if err := respondWithJSONStatus(w, http.StatusForbidden, resp); err != nil {
 			log.Printf("Failed to respond with JSON: %#v", resp)
 		}
 		return
 	}
-	fmt.Printf("Command to run: %#v\n", cmdToRun)
 
-	err = OpenCommandLogWriter(cmdToRun.LogFilePath)
-	cmdExitCode := 0
-	if err == nil {
-		defer func() {
-			if err := CloseCommandLogWriter(); err != nil {
-				log.Println(" [!] Failed to CloseCommandLogWriter:", err)
-			}
-		}()
-		cmdExitCode, err = ExecuteCommand(cmdToRun)
+	// Once the job is accepted the response is streamed (if the client asked for it),
+	//  errors have to be reported through the result frame
+	var streamEncoder *frameEncoder
+	startStream := func() {}
+	if isStreamRequested(r) {
+		streamEncoder = newFrameEncoder(w)
+		startStream = func() {
+			w.Header().Set("Content-Type", streamContentType)
+			w.WriteHeader(http.StatusOK)
+		}
 	}
 
-	//
-	// Response
-	statusMsg := configOkStatusMsg
-	respMsg := "Command finished with success"
+	var respModel ResponseModel
+	job, err := NewJob(cmdToRun, requestClientName(r), streamEncoder)
 	if err != nil {
 		log.Println(" [!] Error: ", err)
-		// WriteLineToCommandLog(fmt.Sprintf(" [!] Error: %s", err))
-		statusMsg = configErrorStatusMsg
-		respMsg = fmt.Sprintf("%s", err)
-	}
-	//
-	respModel := ResponseModel{
-		Status:   statusMsg,
-		Msg:      respMsg,
-		ExitCode: cmdExitCode,
+		startStream()
+		respModel = createErrorResponseModel(fmt.Sprintf("Failed to create job: %s", err), 1)
+	} else {
+		err := serverJobManager.Submit(job, func() {
+			startStream()
+			if streamEncoder != nil {
+				// the client needs the job's ID to be able to cancel it
+				if err := streamEncoder.WriteFrame(StreamFrame{Type: streamFrameTypeJob, JobID: job.ID}); err != nil {
+					log.Println(" [!] Failed to send job frame: ", err)
+				}
+			}
+		})
+		if err != nil {
+			serverMetrics.CountRequestFailure(requestFailureServerBusy)
+			respondWithServerBusy(w, err)
+			return
+		}
+		<-job.Done()
+		respModel = job.Result()
 	}
 
-	if ConfigIsVerboseLogMode {
-		if err := WriteLineToCommandLog("-> Command Finished"); err != nil {
-			log.Println(" [!] Failed to write 'Command Finished' into Command Log")
+	if streamEncoder != nil {
+		if err := respondWithStreamResult(streamEncoder, respModel); err != nil {
+			log.Println(" [!] Failed to send Response: ", err)
 		}
+		return
 	}
 
 	if err := respondWithJSON(w, respModel); err != nil {
@@ -160,22 +261,55 @@ func commandHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func startServer() error {
-	http.HandleFunc("/cmd", commandHandler)
+func startServer(tlsConfig *tls.Config) error {
+	if !serverAuthTokenStore.IsAuthEnabled() {
+		log.Println(" (!) No auth tokens defined - authentication is disabled, anyone who can connect can run commands!")
+	}
+
+	http.HandleFunc("/cmd", requireAuth(commandHandler))
 	http.HandleFunc("/ping", pingHandler)
-	fmt.Println("Ready to serve on port:", configServerPort)
+	http.HandleFunc("/jobs", requireAuth(jobsHandler))
+	http.HandleFunc("/jobs/", requireAuth(jobHandler))
+	http.HandleFunc("/session", requireSessionAuth(sessionHandler))
+	http.HandleFunc("/session/ticket", requireAuth(sessionTicketHandler))
+	http.HandleFunc("/metrics", requireAuth(metricsHandler))
+	server := &http.Server{
+		Addr:      configServer.ListenAddress,
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			log.Println(" (i) TLS client certificate verification enabled")
+		}
+		fmt.Println("Ready to serve (HTTPS) on:", configServer.ListenAddress)
+		fmt.Println()
+		// the certificate is already loaded into tlsConfig
+		return server.ListenAndServeTLS("", "")
+	}
+
+	fmt.Println("Ready to serve on:", configServer.ListenAddress)
 	fmt.Println()
-	return http.ListenAndServe(":"+configServerPort, nil)
+	return server.ListenAndServe()
 }
 
 //
 // --- non server mode
 
-func sendJSONRequestToServer(jsonBytes []byte) (cmdExCode int, cmdErr error) {
+// sendJSONRequestToServer - onJobStarted (optional) is called with the job's ID,
+// once the server started the job
+func sendJSONRequestToServer(jsonBytes []byte, onJobStarted func(jobID string), stdoutWriter, stderrWriter io.Writer) (cmdExCode int, cmdErr error) {
 	cmdExCode = 1
 	cmdErr = nil
 
-	resp, err := http.Post("http://localhost:27473/cmd", "application/json", bytes.NewReader(jsonBytes))
+	req, err := newServerRequest("POST", "/cmd", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return 1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", streamContentType)
+
+	resp, err := serverHTTPClient.Do(req)
 	if err != nil {
 		// handle error
 		log.Println("Failed to send command to cmd-bridge server: ", err)
@@ -187,24 +321,53 @@ func sendJSONRequestToServer(jsonBytes []byte) (cmdExCode int, cmdErr error) {
 		}
 	}()
 
-	respBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println("Failed to read cmd-bridge server response: ", err)
-		return 1, err
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Println("The cmd-bridge server rejected the request: unauthorized - check the auth token (CMD_BRIDGE_TOKEN / -token-file)")
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		log.Printf("The cmd-bridge server is busy, the command was not started (retry after: %ss)", resp.Header.Get("Retry-After"))
 	}
-	respBodyString := string(respBodyBytes)
-
-	vLogln("Response: ", respBodyString)
 
 	var respModel ResponseModel
-	jsonParser := json.NewDecoder(strings.NewReader(respBodyString))
-	if err := jsonParser.Decode(&respModel); err != nil {
-		log.Println("Failed to decode cmd-bridge server response (JSON): ", err)
-		return 1, err
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), streamContentType) {
+		signalForwarder := newJobSignalForwarder()
+		defer signalForwarder.Stop()
+
+		onJobID := func(jobID string) {
+			signalForwarder.SetJobID(jobID)
+			if onJobStarted != nil {
+				onJobStarted(jobID)
+			}
+		}
+
+		respModel, err = readStreamedResponse(resp.Body, stdoutWriter, stderrWriter, onJobID)
+		if err != nil {
+			log.Println("Failed to read cmd-bridge server response stream: ", err)
+			return 1, err
+		}
+	} else {
+		respBodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Println("Failed to read cmd-bridge server response: ", err)
+			return 1, err
+		}
+		respBodyString := string(respBodyBytes)
+
+		vLogln("Response: ", respBodyString)
+
+		jsonParser := json.NewDecoder(strings.NewReader(respBodyString))
+		if err := jsonParser.Decode(&respModel); err != nil {
+			log.Println("Failed to decode cmd-bridge server response (JSON): ", err)
+			return 1, err
+		}
 	}
 	vLogf("respModel: %#v\n", respModel)
 	cmdExCode = respModel.ExitCode
 
+	if respModel.PolicyDenial != nil {
+		logPolicyDenial(respModel.PolicyDenial)
+	}
+
 	if respModel.Status != configOkStatusMsg {
 		return cmdExCode, fmt.Errorf("Server returned an error response: %#v", respModel)
 	}
@@ -216,81 +379,266 @@ func sendJSONRequestToServer(jsonBytes []byte) (cmdExCode int, cmdErr error) {
 	return cmdExCode, nil
 }
 
-func sendCommandToServer(cmdToSend CommandModel, isVerbose bool) (cmdExCode int, cmdErr error) {
-	cmdExCode = 1
-	cmdErr = nil
-
-	tempFile, err := makeTempFile("cmd-bridge-tmp")
-	if err != nil {
-		return 1, err
-	}
-	tmpfilePth := tempFile.Name()
-	vLogln("tmpfilePth: ", tmpfilePth)
-	defer func() {
-		if err := os.Remove(tmpfilePth); err != nil {
-			log.Println(" [!] Failed to os.Remove(tmpfilePth):", err)
-		}
-		if err := tempFile.Close(); err != nil {
-			log.Println(" [!] Failed to tempFile.Close:", err)
+// readStreamedResponse writes the output frames into stdoutWriter / stderrWriter (based on the frame's stream)
+// and returns the response of the closing result frame
+func readStreamedResponse(body io.Reader, stdoutWriter, stderrWriter io.Writer, onJobID func(string)) (ResponseModel, error) {
+	decoder := json.NewDecoder(body)
+	for {
+		var frame StreamFrame
+		if err := decoder.Decode(&frame); err != nil {
+			if err == io.EOF {
+				return ResponseModel{}, errors.New("Response stream ended without a result")
+			}
+			return ResponseModel{}, err
 		}
-	}()
 
-	cmdToSend.LogFilePath = tmpfilePth
+		switch frame.Type {
+		case streamFrameTypeJob:
+			vLogln("Job ID: ", frame.JobID)
+			onJobID(frame.JobID)
+		case streamFrameTypeQueued:
+			log.Printf(" (i) Waiting for a free slot on the cmd-bridge server (queue position: %d)", frame.QueuePosition)
+		case streamFrameTypeOutput:
+			outputWriter := stdoutWriter
+			if frame.Stream == outputStreamStderr {
+				outputWriter = stderrWriter
+			}
+			if _, err := outputWriter.Write(frame.Data); err != nil {
+				return ResponseModel{}, err
+			}
+		case streamFrameTypeResult:
+			if frame.Response == nil {
+				return ResponseModel{}, errors.New("Result frame without a response")
+			}
+			return *frame.Response, nil
+		default:
+			vLogln("Unknown frame type, skipping: ", frame.Type)
+		}
+	}
+}
 
-	vLogln(fmt.Sprintf("Sending command: %#v", cmdToSend))
+// sendCommandToServer - if outputFilePath is specified the command's output (stdout and stderr merged)
+// is written into this (local) file as well
+func sendCommandToServer(cmdToSend CommandModel, outputFilePath string, isVerbose bool) (cmdExCode int, cmdErr error) {
+	vLogln(fmt.Sprintf("Sending command: %#v", commandModelForLog(cmdToSend)))
 
 	cmdBytes, err := json.Marshal(cmdToSend)
 	if err != nil {
 		return 1, err
 	}
 
-	t, err := tail.TailFile(tempFile.Name(), tail.Config{Follow: true})
-	if err != nil {
-		return 1, err
-	}
-	go func() {
-		cmdExCode, cmdErr = sendJSONRequestToServer(cmdBytes)
-		if err := t.Stop(); err != nil {
-			log.Println(" [!] Failed to (tail) t.Stop():", err)
+	var stdoutWriter, stderrWriter io.Writer = os.Stdout, os.Stderr
+	if outputFilePath != "" {
+		outputFile, err := os.Create(outputFilePath)
+		if err != nil {
+			return 1, fmt.Errorf("Failed to create the output file: %s", err)
 		}
-	}()
+		defer func() {
+			if err := outputFile.Close(); err != nil {
+				log.Println(" [!] Failed to close the output file:", err)
+			}
+		}()
+		stdoutWriter = io.MultiWriter(os.Stdout, outputFile)
+		stderrWriter = io.MultiWriter(os.Stderr, outputFile)
+	}
 
-	for line := range t.Lines {
-		fmt.Println(line.Text)
+	// in tty mode the local terminal (if it's one) is switched to raw mode,
+	// everything (including Ctrl-C) is handled by the remote pseudo-terminal
+	if cmdToSend.TTY && isTerminal(os.Stdin) {
+		oldState, err := makeTerminalRaw(os.Stdin)
+		if err != nil {
+			return 1, fmt.Errorf("Failed to switch the terminal to raw mode: %s", err)
+		}
+		defer func() {
+			if err := restoreTerminal(os.Stdin, oldState); err != nil {
+				log.Println(" [!] Failed to restore the terminal:", err)
+			}
+		}()
 	}
 
-	return cmdExCode, cmdErr
+	stopResizeForwarding := func() {}
+	defer func() { stopResizeForwarding() }()
+
+	onJobStarted := func(jobID string) {
+		if cmdToSend.Stdin {
+			go func() {
+				if err := sendStdinToServer(jobID, os.Stdin); err != nil {
+					// e.g. the command exited without reading all of its stdin, the same as a broken pipe locally
+					vLogln(" [!] Failed to send stdin to the cmd-bridge server:", err)
+				}
+			}()
+		}
+		if cmdToSend.TTY && isTerminal(os.Stdout) {
+			stopResizeForwarding = startTerminalResizeForwarding(jobID)
+		}
+	}
+	return sendJSONRequestToServer(cmdBytes, onJobStarted, stdoutWriter, stderrWriter)
 }
 
-func getCommandEnvironments() []EnvironmentKeyValue {
+// getCommandEnvironments collects the environment variables to send, later sources override earlier ones:
+// the variables matching the passEnvPatterns (as they are), the variables with the envPrefix
+// (without the prefix), the env files, and the envFlags (KEY=VALUE items)
+func getCommandEnvironments(envPrefix string, passEnvPatterns, envFiles, envFlags []string) ([]EnvironmentKeyValue, error) {
 	cmdEnvs := []EnvironmentKeyValue{}
+	setEnv := func(key, value string) {
+		for idx, anEnv := range cmdEnvs {
+			if anEnv.Key == key {
+				cmdEnvs = append(cmdEnvs[:idx], cmdEnvs[idx+1:]...)
+				break
+			}
+		}
+		cmdEnvs = append(cmdEnvs, EnvironmentKeyValue{Key: key, Value: value})
+	}
 
+	if err := validateEnvPatterns(passEnvPatterns); err != nil {
+		return nil, fmt.Errorf("Invalid -pass-env: %s", err)
+	}
 	for _, anEnv := range os.Environ() {
-		splits := strings.Split(anEnv, "=")
-		keyWithPrefix := splits[0]
-		if strings.HasPrefix(keyWithPrefix, configCommandEnvPrefix) {
-			cmdEnvItem := EnvironmentKeyValue{
-				Key:   keyWithPrefix[len(configCommandEnvPrefix):],
-				Value: os.Getenv(keyWithPrefix),
+		splits := strings.SplitN(anEnv, "=", 2)
+		if len(splits) != 2 || splits[0] == "" {
+			continue
+		}
+		if matchesAnyEnvPattern(splits[0], passEnvPatterns) {
+			setEnv(splits[0], splits[1])
+		}
+	}
+	if envPrefix != "" {
+		for _, anEnv := range os.Environ() {
+			splits := strings.SplitN(anEnv, "=", 2)
+			if len(splits) == 2 && strings.HasPrefix(splits[0], envPrefix) && len(splits[0]) > len(envPrefix) {
+				setEnv(splits[0][len(envPrefix):], splits[1])
 			}
-			cmdEnvs = append(cmdEnvs, cmdEnvItem)
 		}
 	}
 
-	vLogf("cmdEnvs: %#v\n", cmdEnvs)
+	for _, anEnvFile := range envFiles {
+		fileEnvs, err := readEnvFile(anEnvFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, anEnv := range fileEnvs {
+			setEnv(anEnv.Key, anEnv.Value)
+		}
+	}
+
+	for _, anEnvFlag := range envFlags {
+		splits := strings.SplitN(anEnvFlag, "=", 2)
+		if len(splits) != 2 || splits[0] == "" {
+			return nil, fmt.Errorf("Invalid -env: %s, expected KEY=VALUE", anEnvFlag)
+		}
+		setEnv(splits[0], splits[1])
+	}
 
-	return cmdEnvs
+	if ConfigIsVerboseLogMode {
+		log.Printf("Environment variables to send (%d):", len(cmdEnvs))
+		for _, anEnv := range cmdEnvs {
+			log.Printf("  %s=%s", anEnv.Key, redactedValue(anEnv.Value))
+		}
+	}
+
+	return cmdEnvs, nil
+}
+
+// redactedValue - environment variable values (e.g. secrets) are never logged
+func redactedValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+// commandModelForLog returns a copy of the command, with the environment variable values redacted
+func commandModelForLog(cmdToRun CommandModel) CommandModel {
+	redactedEnvs := make([]EnvironmentKeyValue, len(cmdToRun.Environments))
+	for idx, anEnv := range cmdToRun.Environments {
+		redactedEnvs[idx] = EnvironmentKeyValue{Key: anEnv.Key, Value: redactedValue(anEnv.Value)}
+	}
+	cmdToRun.Environments = redactedEnvs
+	return cmdToRun
+}
+
+// subcommandAttachShell - starts an interactive session: a login shell (or the -do command) in a pseudo-terminal
+const subcommandAttachShell = "attach-shell"
+
+// subcommandRun - runs the program given after it, with the exact arguments (no shell involved)
+const subcommandRun = "run"
+
+// subcommandJobs - lists the server's jobs (the job history)
+const subcommandJobs = "jobs"
+
+// serverConfigFlags - flag name -> the server config key it sets
+var serverConfigFlags = map[string]string{
+	"addr":                 "listen_address",
+	"default-timeout":      "default_timeout",
+	"max-timeout":          "max_timeout",
+	"timeout-grace-period": "timeout_grace_period",
+	"token-file":           "token_file",
+	"policy-file":          "policy_file",
+	"history-dir":          "history_directory",
+	"tls-cert":             "tls_cert",
+	"tls-key":              "tls_key",
+	"tls-client-ca":        "tls_client_ca",
 }
 
 func main() {
+	// started by the server, to run a command with resource limits
+	if len(os.Args) > 1 && os.Args[1] == execHelperArg {
+		os.Exit(runExecHelper(os.Args[2:]))
+	}
+
 	var (
 		doCommand      = flag.String("do", "", "Connect to a running cmd-bridge and do the specified command")
 		flagCmdWorkDir = flag.String("workdir", "", "Working directory of the specified command.")
+		flagCmdTimeout = flag.Int("timeout", 0, "Timeout of the specified command, in seconds. If not specified the server's default timeout is used.")
+		flagStdin      = flag.Bool("stdin", false, "Forward stdin (e.g. a pipe or a file) to the command, until EOF. Without it the command's stdin is empty, except in -tty mode in a terminal.")
+		flagJobsStatus = flag.String("status", "", "[jobs] List only the jobs with these statuses (comma separated): queued, running, ok, error")
+		flagJobsSince  = flag.String("since", "", "[jobs] List only the jobs created since this time: RFC 3339 time, or a duration (that long ago, e.g. 24h)")
+		flagJobsUntil  = flag.String("until", "", "[jobs] List only the jobs created until this time: RFC 3339 time, or a duration (that long ago, e.g. 1h)")
+		flagJobsExit   = flag.String("exit-code", "", "[jobs] List only the finished jobs with this exit code")
+		flagJobsClient = flag.String("client", "", "[jobs] List only the jobs of this client")
+		flagJobsLimit  = flag.Int("limit", 0, "[jobs] Max number of jobs to list (the newest ones). Default: the server's default (100)")
+		flagJobsJSON   = flag.Bool("json", false, "[jobs] Print the server's JSON response instead of a table")
+		flagOutputFile = flag.String("output-file", "", "Write the command's output (stdout and stderr merged) into this file as well, on this machine. Not available for attach-shell.")
+		flagNoQueue    = flag.Bool("no-queue", false, "Fail right away (instead of waiting in the server's queue) if the server has no free slot to run the command.")
+		flagTTY        = flag.Bool("tty", false, "Run the command in a pseudo-terminal. If this process runs in a terminal, the terminal is switched to raw mode, and its size changes are forwarded.")
+		flagShell      = flag.String("shell", "", "Shell to run the command with (path, or only its name, e.g. zsh), it has to be allowed by the server. Default: the server's default shell.")
+		flagLogin      = flag.Bool("login", false, "Run the shell as a login shell (-login), or as a non-login shell (-login=false). If not specified the server's default (login_shell) is used.")
+		flagUser       = flag.String("user", "", "Run the command as this user (name or uid). The server has to run as root, and allow the identity for this client.")
+		flagGroup      = flag.String("group", "", "Run the command with this group (name or gid), requires -user. Default: the user's primary group.")
+		flagNice       = flag.Int("nice", 0, "Nice level (-20 - 19) of the command. Default: the server's nice level.")
+		flagCPUTime    = flag.Int("limit-cpu-time", 0, "CPU time limit of the command (of each of its processes), in seconds. The server's max_cpu_time caps it.")
+		flagAddrSpace  = flag.Int("limit-address-space-mb", 0, "Virtual memory limit of the command (of each of its processes), in MB. The server's max_address_space_mb caps it.")
+		flagOpenFiles  = flag.Int("limit-open-files", 0, "Open files limit of the command (of each of its processes). The server's max_open_files caps it.")
+		flagProcesses  = flag.Int("limit-processes", 0, "Max number of processes of the command's user. The server's max_processes caps it.")
+		flagCoreSize   = flag.Int("limit-core-size-mb", 0, "Max core dump size of the command, in MB, 0 disables core dumps. The server's max_core_size_mb caps it.")
+		flagEnvPrefix  = flag.String("env-prefix", envOrDefault("CMD_BRIDGE_ENV_PREFIX", configCommandEnvPrefix), "Environment variables with this prefix are sent to the command, without the prefix. Empty to disable. Can also be set with the CMD_BRIDGE_ENV_PREFIX environment variable.")
+		flagServerURL  = flag.String("server", envOrDefault("CMD_BRIDGE_SERVER_URL", configServerURL), "URL of the cmd-bridge server to connect to. Can also be set with the CMD_BRIDGE_SERVER_URL environment variable.")
+		flagTokenFile  = flag.String("token-file", os.Getenv("CMD_BRIDGE_TOKEN_FILE"), "Server mode: file with the accepted auth tokens, one name:token pair per line (re-read when changed), config key: token_file. Non-server mode: file with the auth token to send (the CMD_BRIDGE_TOKEN environment variable takes precedence). Can also be set with the CMD_BRIDGE_TOKEN_FILE environment variable.")
+		flagConfigFile = flag.String("config", os.Getenv("CMD_BRIDGE_CONFIG"), "[server mode] Config file (JSON). Every config key can be overridden with a CMD_BRIDGE_<KEY> environment variable, and the flags below override both. Can also be set with the CMD_BRIDGE_CONFIG environment variable.")
+		_              = flag.String("addr", configServer.ListenAddress, "[server mode] Address (host:port) to listen on, or only a port to listen on the loopback interface. Config key: listen_address")
+		_              = flag.Duration("default-timeout", 0, "[server mode] Timeout of commands which don't specify one. 0 means no timeout. Config key: default_timeout")
+		_              = flag.Duration("max-timeout", 0, "[server mode] Maximum timeout of commands. 0 means no limit. Config key: max_timeout")
+		_              = flag.Duration("timeout-grace-period", time.Duration(configServer.TimeoutGracePeriod), "[server mode] Time to wait after sending SIGTERM to a timed out command, before it's killed with SIGKILL. Config key: timeout_grace_period")
+		_              = flag.String("policy-file", "", "[server mode] Command policy file (JSON), re-read when changed. Config key: policy_file")
+		_              = flag.String("history-dir", "", "[server mode] Directory to store the job history in (it survives restarts). Default: the history is only kept in memory. Config key: history_directory")
+		_              = flag.String("tls-cert", "", "[server mode] TLS certificate (PEM) file, enables HTTPS. Config key: tls_cert")
+		_              = flag.String("tls-key", "", "[server mode] TLS private key (PEM) file. Config key: tls_key")
+		_              = flag.String("tls-client-ca", "", "[server mode] CA certificate(s) (PEM) file, if specified clients have to present a certificate issued by one of these CAs. Config key: tls_client_ca")
+		flagCACert     = flag.String("ca-cert", os.Getenv("CMD_BRIDGE_CA_CERT"), "CA certificate(s) (PEM) file to verify the server's certificate with, instead of the system's CAs. Can also be set with the CMD_BRIDGE_CA_CERT environment variable.")
+		flagClientCert = flag.String("client-cert", os.Getenv("CMD_BRIDGE_CLIENT_CERT"), "Client certificate (PEM) file to present to the server. Can also be set with the CMD_BRIDGE_CLIENT_CERT environment variable.")
+		flagClientKey  = flag.String("client-key", os.Getenv("CMD_BRIDGE_CLIENT_KEY"), "Client certificate's private key (PEM) file. Can also be set with the CMD_BRIDGE_CLIENT_KEY environment variable.")
 		isHelp         = flag.Bool("help", false, "Show help")
 		isVerbose      = flag.Bool("verbose", false, "Verbose output")
 		isVersion      = flag.Bool("version", false, "Prints version")
 	)
 
+	var flagEnvs, flagEnvFiles, flagPassEnvs, flagPolicyFlags, flagCPUAffinity stringListFlag
+	flag.Var(&flagCPUAffinity, "cpu-affinity", "CPUs (0 based, comma separated) the command can run on (Linux servers only). Can be specified multiple times.")
+	flag.Var(&flagPolicyFlags, "policy-flag", "Policy flag to send with the command, required by the server's require_flag policy rules. Can be specified multiple times.")
+	flag.Var(&flagEnvs, "env", "Environment variable (KEY=VALUE) to send to the command. Can be specified multiple times, overrides the other sources.")
+	flag.Var(&flagEnvFiles, "env-file", "Dotenv file (KEY=VALUE lines) with environment variables to send to the command. Can be specified multiple times.")
+	flag.Var(&flagPassEnvs, "pass-env", "Environment variables (glob patterns, e.g. 'BITRISE_*', comma separated) to send to the command as they are, without a prefix. Can be specified multiple times.")
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -309,11 +657,84 @@ func main() {
 		ConfigIsVerboseLogMode = true
 	}
 
+	subcommand := flag.Arg(0)
+	switch subcommand {
+	case "":
+	case subcommandAttachShell, subcommandRun, subcommandJobs:
+		// flags can be specified after the subcommand as well
+		if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		if subcommand == subcommandRun {
+			if flag.NArg() == 0 {
+				log.Fatal("No program specified, usage: cmd-bridge run [FLAGS] -- PROGRAM [ARGS...]")
+			}
+			if *doCommand != "" {
+				log.Fatal("-do can't be used with run")
+			}
+		} else if flag.NArg() > 0 {
+			log.Fatalf("Unexpected argument: %s (see -help)", flag.Arg(0))
+		}
+		if subcommand == subcommandAttachShell && *flagOutputFile != "" {
+			log.Fatal("-output-file can't be used with attach-shell")
+		}
+	default:
+		log.Fatalf("Unknown command: %s (see -help)", subcommand)
+	}
+
 	// --- server mode
 
-	if *doCommand == "" {
+	if *doCommand == "" && subcommand == "" {
+		config, err := LoadServerConfig(*flagConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// explicitly specified flags override the config file and the environment
+		var flagErr error
+		flag.Visit(func(f *flag.Flag) {
+			if configKey, isServerConfigFlag := serverConfigFlags[f.Name]; isServerConfigFlag && flagErr == nil {
+				if err := config.Set(configKey, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("Invalid -%s: %s", f.Name, err)
+				}
+			}
+		})
+		if flagErr != nil {
+			log.Fatal(flagErr)
+		}
+		config.ListenAddress = normalizeListenAddress(config.ListenAddress)
+		if err := config.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		configServer = config
+		serverJobManager = NewJobManager(configServer.MaxConcurrentJobs, configServer.MaxQueuedJobs)
+
+		tokenStore, err := NewAuthTokenStore(configServer.TokenFile, os.Getenv("CMD_BRIDGE_TOKENS"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverAuthTokenStore = tokenStore
+
+		policyStore, err := NewCommandPolicyStore(configServer.PolicyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverCommandPolicyStore = policyStore
+
+		jobHistory, err := NewJobHistoryStore(configServer.HistoryDirectory, time.Duration(configServer.HistoryRetention))
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverJobHistory = jobHistory
+		serverJobHistory.StartCleanup()
+		StartJobLogCleanup(configServer.LogDirectory, time.Duration(configServer.LogRetention))
+
+		tlsConfig, err := createServerTLSConfig(configServer.TLSCert, configServer.TLSKey, configServer.TLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		fmt.Println("No command specified - starting server...")
-		if err := startServer(); err != nil {
+		if err := startServer(tlsConfig); err != nil {
 			log.Fatal(err)
 			os.Exit(1)
 		}
@@ -322,13 +743,101 @@ func main() {
 
 	// --- non-server mode
 
-	doCmdEnvs := getCommandEnvironments()
+	configServerURL = strings.TrimSuffix(*flagServerURL, "/")
+	authToken, err := readClientAuthToken(*flagTokenFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configClientAuthToken = authToken
+
+	httpClient, err := createClientHTTPClient(*flagCACert, *flagClientCert, *flagClientKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverHTTPClient = httpClient
+
+	if subcommand == subcommandJobs {
+		query := url.Values{}
+		for key, value := range map[string]string{"status": *flagJobsStatus, "since": *flagJobsSince, "until": *flagJobsUntil, "exit_code": *flagJobsExit, "client": *flagJobsClient} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		if *flagJobsLimit > 0 {
+			query.Set("limit", strconv.Itoa(*flagJobsLimit))
+		}
+		if err := listJobsFromServer(query, *flagJobsJSON); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	var runArgs []string
+	if subcommand == subcommandRun {
+		runArgs = flag.Args()
+	}
+
+	passEnvPatterns := []string{}
+	for _, aPatternList := range flagPassEnvs {
+		for _, aPattern := range strings.Split(aPatternList, ",") {
+			if aPattern = strings.TrimSpace(aPattern); aPattern != "" {
+				passEnvPatterns = append(passEnvPatterns, aPattern)
+			}
+		}
+	}
+	doCmdEnvs, err := getCommandEnvironments(*flagEnvPrefix, passEnvPatterns, flagEnvFiles, flagEnvs)
+	if err != nil {
+		log.Fatal(err)
+	}
 	cmdToSend := CommandModel{
-		Command:          *doCommand,
+		Command: *doCommand,
+		Args:    runArgs,
+		Shell:   *flagShell,
+		User:    *flagUser,
+		Group:   *flagGroup,
+		Nice:    *flagNice,
+		Limits: &CommandLimitsModel{
+			CPUTime:        *flagCPUTime,
+			AddressSpaceMB: *flagAddrSpace,
+			OpenFiles:      *flagOpenFiles,
+			Processes:      *flagProcesses,
+		},
+		PolicyFlags:      flagPolicyFlags,
 		Environments:     doCmdEnvs,
 		WorkingDirectory: *flagCmdWorkDir,
+		Timeout:          *flagCmdTimeout,
+		Stdin:            *flagStdin || (*flagTTY && isTerminal(os.Stdin)),
+		TTY:              *flagTTY,
+		NoQueue:          *flagNoQueue,
+	}
+	cmdToSend.CPUAffinity, err = parseCPUList(flagCPUAffinity)
+	if err != nil {
+		log.Fatalf("Invalid -cpu-affinity: %s", err)
+	}
+	// only sent if it's explicitly specified, the server has a default
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "login":
+			cmdToSend.Login = flagLogin
+		case "limit-core-size-mb":
+			cmdToSend.Limits.CoreSizeMB = flagCoreSize
+		}
+	})
+	if *cmdToSend.Limits == (CommandLimitsModel{}) {
+		cmdToSend.Limits = nil
+	}
+	if cmdToSend.TTY && isTerminal(os.Stdout) {
+		if size, err := getTerminalSize(os.Stdout); err == nil {
+			cmdToSend.TTYSize = &size
+		}
+	}
+	var cmdExCode int
+	var cmdErr error
+	if subcommand == subcommandAttachShell {
+		cmdExCode, cmdErr = attachShellToServer(cmdToSend)
+	} else {
+		cmdExCode, cmdErr = sendCommandToServer(cmdToSend, *flagOutputFile, *isVerbose)
 	}
-	cmdExCode, cmdErr := sendCommandToServer(cmdToSend, *isVerbose)
 	if cmdErr != nil {
 		vLogln("Error: ", cmdErr)
 		if cmdExCode != 0 {
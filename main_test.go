@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the server starts the exec helper with its own executable, which is the test binary in tests
+	if len(os.Args) > 1 && os.Args[1] == execHelperArg {
+		os.Exit(runExecHelper(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// executeTestCommand runs the command with ExecuteCommand, logged into a file,
+// returns the exit code and the log's content
+func executeTestCommand(t *testing.T, cmdToRun CommandModel) (int, string, error) {
+	t.Helper()
+
+	logFilePath := filepath.Join(t.TempDir(), "command.log")
+	logWriter, err := OpenCommandLogWriter(logFilePath, logFormatRaw, "", 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to open log writer: %s", err)
+	}
+	exitCode, cmdErr := ExecuteCommand(cmdToRun, nil, nil, logWriter, &CommandProcessGroup{})
+	if err := logWriter.Close(); err != nil {
+		t.Fatalf("Failed to close log writer: %s", err)
+	}
+
+	logBytes, err := ioutil.ReadFile(logFilePath)
+	if err != nil {
+		t.Fatalf("Failed to read log: %s", err)
+	}
+	return exitCode, string(logBytes), cmdErr
+}
+
+func TestCommandModelForLog(t *testing.T) {
+	cmdToRun := CommandModel{
+		Command:      "deploy",
+		Environments: []EnvironmentKeyValue{{Key: "API_KEY", Value: "secret"}, {Key: "EMPTY", Value: ""}},
+	}
+
+	logged := fmt.Sprintf("%#v", commandModelForLog(cmdToRun))
+	if strings.Contains(logged, "secret") {
+		t.Fatalf("The env value should be redacted, got: %s", logged)
+	}
+	for _, aWant := range []string{"API_KEY", "[REDACTED]", "deploy"} {
+		if !strings.Contains(logged, aWant) {
+			t.Errorf("Should contain %q, got: %s", aWant, logged)
+		}
+	}
+	if cmdToRun.Environments[0].Value != "secret" {
+		t.Fatalf("The command itself should not be modified, got: %#v", cmdToRun.Environments)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	commandOutcomeSuccess   = "success"
+	commandOutcomeNonZero   = "non_zero"
+	commandOutcomeError     = "error"
+	commandOutcomeTimeout   = "timeout"
+	commandOutcomeCancelled = "cancelled"
+
+	requestFailureInvalid      = "invalid_request"
+	requestFailurePolicyDenied = "policy_denied"
+	requestFailureServerBusy   = "server_busy"
+)
+
+var (
+	commandOutcomes = []string{commandOutcomeSuccess, commandOutcomeNonZero, commandOutcomeError, commandOutcomeTimeout, commandOutcomeCancelled}
+	requestFailures = []string{requestFailureInvalid, requestFailurePolicyDenied, requestFailureServerBusy}
+	outputStreams   = []string{outputStreamStdout, outputStreamStderr}
+
+	// configCommandDurationBuckets - the upper bounds of the command duration histogram's buckets, in seconds
+	configCommandDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600, 7200}
+)
+
+// serverMetrics - the server's metrics, served on /metrics
+var serverMetrics = NewMetrics()
+
+// Metrics ...
+// The counters of the server, since it was started.
+type Metrics struct {
+	mu                     sync.Mutex
+	commandCounts          map[string]uint64
+	commandDurationBuckets []uint64
+	commandDurationSum     float64
+	commandDurationCount   uint64
+	requestFailureCounts   map[string]uint64
+	authFailureCount       uint64
+	outputByteCounts       map[string]uint64
+}
+
+// NewMetrics ...
+func NewMetrics() *Metrics {
+	return &Metrics{
+		commandCounts:          map[string]uint64{},
+		commandDurationBuckets: make([]uint64, len(configCommandDurationBuckets)),
+		requestFailureCounts:   map[string]uint64{},
+		outputByteCounts:       map[string]uint64{},
+	}
+}
+
+// CountCommand - a command finished with this outcome
+func (m *Metrics) CountCommand(outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commandCounts[outcome]++
+}
+
+// ObserveCommandDuration - a command ran this long (without the time it spent in the queue)
+func (m *Metrics) ObserveCommandDuration(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := duration.Seconds()
+	for idx, anUpperBound := range configCommandDurationBuckets {
+		if seconds <= anUpperBound {
+			m.commandDurationBuckets[idx]++
+		}
+	}
+	m.commandDurationSum += seconds
+	m.commandDurationCount++
+}
+
+// CountRequestFailure - a command was not accepted, for this reason
+func (m *Metrics) CountRequestFailure(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requestFailureCounts[reason]++
+}
+
+// CountAuthFailure - a request was rejected, because it had no valid auth token
+func (m *Metrics) CountAuthFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authFailureCount++
+}
+
+// CountOutputBytes - the commands wrote this many bytes into the stream (stdout / stderr)
+func (m *Metrics) CountOutputBytes(stream string, byteCount int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outputByteCounts[stream] += uint64(byteCount)
+}
+
+// WriteTo writes the metrics in the Prometheus text format,
+// the running and queued jobs are the current counts of the job manager
+func (m *Metrics) WriteTo(w io.Writer, runningJobs, queuedJobs int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sb := strings.Builder{}
+	writeHeader := func(name, metricType, help string) {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType))
+	}
+	writeLabeledCounts := func(name, label string, values []string, counts map[string]uint64) {
+		for _, aValue := range values {
+			sb.WriteString(fmt.Sprintf("%s{%s=%q} %d\n", name, label, aValue, counts[aValue]))
+		}
+		// values which are not known in advance
+		extraValues := []string{}
+		for aValue := range counts {
+			if !sliceIncludes(values, aValue) {
+				extraValues = append(extraValues, aValue)
+			}
+		}
+		sort.Strings(extraValues)
+		for _, aValue := range extraValues {
+			sb.WriteString(fmt.Sprintf("%s{%s=%q} %d\n", name, label, aValue, counts[aValue]))
+		}
+	}
+
+	writeHeader("cmd_bridge_commands_total", "counter", "Finished commands, by outcome.")
+	writeLabeledCounts("cmd_bridge_commands_total", "outcome", commandOutcomes, m.commandCounts)
+
+	writeHeader("cmd_bridge_command_duration_seconds", "histogram", "Duration of the commands, without the time spent in the queue.")
+	for idx, anUpperBound := range configCommandDurationBuckets {
+		sb.WriteString(fmt.Sprintf("cmd_bridge_command_duration_seconds_bucket{le=%q} %d\n",
+			strconv.FormatFloat(anUpperBound, 'g', -1, 64), m.commandDurationBuckets[idx]))
+	}
+	sb.WriteString(fmt.Sprintf("cmd_bridge_command_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.commandDurationCount))
+	sb.WriteString(fmt.Sprintf("cmd_bridge_command_duration_seconds_sum %s\n", strconv.FormatFloat(m.commandDurationSum, 'g', -1, 64)))
+	sb.WriteString(fmt.Sprintf("cmd_bridge_command_duration_seconds_count %d\n", m.commandDurationCount))
+
+	writeHeader("cmd_bridge_running_jobs", "gauge", "Jobs running right now.")
+	sb.WriteString(fmt.Sprintf("cmd_bridge_running_jobs %d\n", runningJobs))
+	writeHeader("cmd_bridge_queued_jobs", "gauge", "Jobs waiting for a free slot right now.")
+	sb.WriteString(fmt.Sprintf("cmd_bridge_queued_jobs %d\n", queuedJobs))
+
+	writeHeader("cmd_bridge_request_failures_total", "counter", "Commands which were not accepted, by reason.")
+	writeLabeledCounts("cmd_bridge_request_failures_total", "reason", requestFailures, m.requestFailureCounts)
+
+	writeHeader("cmd_bridge_auth_failures_total", "counter", "Requests rejected because of a missing or invalid auth token.")
+	sb.WriteString(fmt.Sprintf("cmd_bridge_auth_failures_total %d\n", m.authFailureCount))
+
+	writeHeader("cmd_bridge_output_bytes_total", "counter", "Bytes of output written by the commands, by stream.")
+	writeLabeledCounts("cmd_bridge_output_bytes_total", "stream", outputStreams, m.outputByteCounts)
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func sliceIncludes(items []string, item string) bool {
+	for _, anItem := range items {
+		if anItem == item {
+			return true
+		}
+	}
+	return false
+}
+
+// commandOutcome - the outcome of a command which was started,
+// err is the error ExecuteCommand returned
+func commandOutcome(err error, isCancelled, isTimedOut bool) string {
+	switch {
+	case isCancelled:
+		return commandOutcomeCancelled
+	case isTimedOut:
+		return commandOutcomeTimeout
+	case err == nil:
+		return commandOutcomeSuccess
+	}
+	// the command ran, and exited with a non zero exit code (or was terminated by a signal)
+	if _, isExitError := err.(*exec.ExitError); isExitError {
+		return commandOutcomeNonZero
+	}
+	return commandOutcomeError
+}
+
+// metricsOutputWriter counts the bytes written into the command's output stream
+type metricsOutputWriter struct {
+	writer io.Writer
+	stream string
+}
+
+func (w metricsOutputWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	serverMetrics.CountOutputBytes(w.stream, n)
+	return n, err
+}
+
+// metricsHandler handles: GET /metrics - the server's metrics, in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondWithError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method not allowed: %s", r.Method))
+		return
+	}
+
+	runningJobs, queuedJobs := serverJobManager.Counts()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := serverMetrics.WriteTo(w, runningJobs, queuedJobs); err != nil {
+		log.Println(" [!] Failed to send metrics:", err)
+	}
+}
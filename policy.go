@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	policyActionAllow       = "allow"
+	policyActionDeny        = "deny"
+	policyActionRequireFlag = "require_flag"
+)
+
+// CommandPolicyRuleModel ...
+// A rule matches a command if all of its specified conditions match (an empty condition matches anything).
+// Patterns are wildcard patterns: * matches any characters (including /), ? matches a single character.
+type CommandPolicyRuleModel struct {
+	// Name - identifies the rule in denials and in the server's log
+	Name string `json:"name"`
+	// Action - allow, deny or require_flag (allowed only if the request has the Flag in its policy_flags)
+	Action string `json:"action"`
+	Flag   string `json:"flag,omitempty"`
+	// Message - optional, included in the denial
+	Message string `json:"message,omitempty"`
+
+	// Clients - the client's name (auth token name, or cert:COMMON_NAME)
+	Clients []string `json:"clients,omitempty"`
+	// Commands - the command's text (for args: the args joined with spaces)
+	Commands []string `json:"commands,omitempty"`
+	// Programs - the program: args[0], or the first word of the command's text
+	Programs []string `json:"programs,omitempty"`
+	// WorkingDirectories - matches if the working directory is one of these directories, or inside one of these
+	WorkingDirectories []string `json:"working_directories,omitempty"`
+	// EnvKeys - matches if any of the command's environment variable keys matches
+	EnvKeys []string `json:"env_keys,omitempty"`
+	// Shell - true: matches only commands run with a shell (command), false: only commands run directly (args).
+	// A shell command's text can contain anything (e.g. "git status; rm -rf ~"),
+	// allow rules for less trusted clients should only match args.
+	Shell *bool `json:"shell,omitempty"`
+}
+
+// CommandPolicyModel ...
+// The rules are evaluated in order, the first matching rule decides.
+// If no rule matches the DefaultAction (allow or deny) applies.
+type CommandPolicyModel struct {
+	DefaultAction string                   `json:"default_action"`
+	Rules         []CommandPolicyRuleModel `json:"rules"`
+}
+
+// PolicyDenialModel ...
+// Why the command was denied by the command policy.
+type PolicyDenialModel struct {
+	// Rule - the name of the rule which denied the command, empty if the default action did
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason"`
+	// RequiredFlag - the command would be allowed with this policy flag
+	RequiredFlag string `json:"required_flag,omitempty"`
+}
+
+// CommandPolicyStore ...
+// Holds the command policy loaded from the policy file. The file is re-read when it changes,
+// if the changed file is invalid the previously loaded policy stays active.
+type CommandPolicyStore struct {
+	mu          sync.Mutex
+	filePath    string
+	fileModTime time.Time
+	fileSize    int64
+	policy      *CommandPolicyModel
+}
+
+var serverCommandPolicyStore = &CommandPolicyStore{}
+
+// NewCommandPolicyStore ...
+// Without a policy file every command is allowed.
+func NewCommandPolicyStore(policyFilePath string) (*CommandPolicyStore, error) {
+	store := &CommandPolicyStore{filePath: policyFilePath}
+	if policyFilePath != "" {
+		if err := store.reloadPolicyFileIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Evaluate ...
+// Returns nil if the command is allowed.
+func (store *CommandPolicyStore) Evaluate(cmdToRun CommandModel, clientName string) *PolicyDenialModel {
+	if store.filePath == "" {
+		return nil
+	}
+	if err := store.reloadPolicyFileIfChanged(); err != nil {
+		log.Println(" [!] Failed to reload policy file, using the previously loaded policy:", err)
+	}
+
+	store.mu.Lock()
+	policy := store.policy
+	store.mu.Unlock()
+	return policy.evaluate(cmdToRun, clientName)
+}
+
+func (store *CommandPolicyStore) reloadPolicyFileIfChanged() error {
+	fileInfo, err := os.Stat(store.filePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read policy file: %s", err)
+	}
+
+	store.mu.Lock()
+	isChanged := store.policy == nil || !fileInfo.ModTime().Equal(store.fileModTime) || fileInfo.Size() != store.fileSize
+	store.mu.Unlock()
+	if !isChanged {
+		return nil
+	}
+
+	policy, err := readCommandPolicyFile(store.filePath)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	store.policy = policy
+	store.fileModTime = fileInfo.ModTime()
+	store.fileSize = fileInfo.Size()
+	store.mu.Unlock()
+
+	log.Printf(" (i) Loaded %d policy rule(s) from: %s", len(policy.Rules), store.filePath)
+	return nil
+}
+
+func readCommandPolicyFile(pth string) (*CommandPolicyModel, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open policy file: %s", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(" [!] Failed to close policy file:", err)
+		}
+	}()
+
+	var policy CommandPolicyModel
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("Invalid policy file (%s): %s", pth, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid policy file (%s): %s", pth, err)
+	}
+	return &policy, nil
+}
+
+// Validate ...
+func (policy *CommandPolicyModel) Validate() error {
+	problems := []string{}
+	if policy.DefaultAction != policyActionAllow && policy.DefaultAction != policyActionDeny {
+		problems = append(problems, fmt.Sprintf("default_action: should be allow or deny, got: %q", policy.DefaultAction))
+	}
+	for idx, aRule := range policy.Rules {
+		ruleID := fmt.Sprintf("rules[%d]", idx)
+		if aRule.Name != "" {
+			ruleID = fmt.Sprintf("rules[%d] (%s)", idx, aRule.Name)
+		}
+		switch aRule.Action {
+		case policyActionAllow, policyActionDeny:
+			if aRule.Flag != "" {
+				problems = append(problems, fmt.Sprintf("%s: flag can only be used with the require_flag action", ruleID))
+			}
+		case policyActionRequireFlag:
+			if aRule.Flag == "" {
+				problems = append(problems, fmt.Sprintf("%s: flag is required for the require_flag action", ruleID))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: action should be allow, deny or require_flag, got: %q", ruleID, aRule.Action))
+		}
+		for _, aDir := range aRule.WorkingDirectories {
+			if !filepath.IsAbs(aDir) {
+				problems = append(problems, fmt.Sprintf("%s: working_directories should be absolute paths, got: %s", ruleID, aDir))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func (policy *CommandPolicyModel) evaluate(cmdToRun CommandModel, clientName string) *PolicyDenialModel {
+	for _, aRule := range policy.Rules {
+		if !aRule.matches(cmdToRun, clientName) {
+			continue
+		}
+
+		switch aRule.Action {
+		case policyActionAllow:
+			return nil
+		case policyActionRequireFlag:
+			for _, aFlag := range cmdToRun.PolicyFlags {
+				if aFlag == aRule.Flag {
+					return nil
+				}
+			}
+			return &PolicyDenialModel{
+				Rule:         aRule.Name,
+				Reason:       policyDenialReason(aRule, fmt.Sprintf("the command requires the %s policy flag", aRule.Flag)),
+				RequiredFlag: aRule.Flag,
+			}
+		default:
+			return &PolicyDenialModel{
+				Rule:   aRule.Name,
+				Reason: policyDenialReason(aRule, "the command is denied by the policy"),
+			}
+		}
+	}
+
+	if policy.DefaultAction == policyActionAllow {
+		return nil
+	}
+	return &PolicyDenialModel{Reason: "the command is not allowed by any policy rule"}
+}
+
+func policyDenialReason(rule CommandPolicyRuleModel, defaultReason string) string {
+	if rule.Message != "" {
+		return rule.Message
+	}
+	return defaultReason
+}
+
+func (rule CommandPolicyRuleModel) matches(cmdToRun CommandModel, clientName string) bool {
+	if len(rule.Clients) > 0 && !matchesAnyWildcard(clientName, rule.Clients) {
+		return false
+	}
+
+	if rule.Shell != nil && *rule.Shell != (len(cmdToRun.Args) == 0) {
+		return false
+	}
+
+	commandText := cmdToRun.Command
+	program := ""
+	if len(cmdToRun.Args) > 0 {
+		commandText = strings.Join(cmdToRun.Args, " ")
+		program = cmdToRun.Args[0]
+	} else if fields := strings.Fields(cmdToRun.Command); len(fields) > 0 {
+		program = fields[0]
+	}
+	if len(rule.Commands) > 0 && !matchesAnyWildcard(strings.TrimSpace(commandText), rule.Commands) {
+		return false
+	}
+	if len(rule.Programs) > 0 && !matchesAnyWildcard(program, rule.Programs) {
+		return false
+	}
+
+	if len(rule.WorkingDirectories) > 0 {
+		workingDir := policyWorkingDirectory(cmdToRun.WorkingDirectory)
+		isInAny := false
+		for _, aDir := range rule.WorkingDirectories {
+			if isPathInDirectory(workingDir, filepath.Clean(aDir)) {
+				isInAny = true
+				break
+			}
+		}
+		if !isInAny {
+			return false
+		}
+	}
+
+	if len(rule.EnvKeys) > 0 {
+		isAnyMatching := false
+		for _, anEnv := range cmdToRun.Environments {
+			if matchesAnyWildcard(anEnv.Key, rule.EnvKeys) {
+				isAnyMatching = true
+				break
+			}
+		}
+		if !isAnyMatching {
+			return false
+		}
+	}
+	return true
+}
+
+// policyWorkingDirectory - the absolute, symlink resolved (if it exists) working directory,
+// an empty working directory means the server's current directory
+func policyWorkingDirectory(workingDirectory string) string {
+	dir := workingDirectory
+	if dir == "" {
+		if currentDir, err := os.Getwd(); err == nil {
+			dir = currentDir
+		}
+	}
+	if absDir, err := filepath.Abs(dir); err == nil {
+		dir = absDir
+	}
+	if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolvedDir
+	}
+	return dir
+}
+
+func matchesAnyWildcard(s string, patterns []string) bool {
+	for _, aPattern := range patterns {
+		if matchWildcard(aPattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard - * matches any characters (including /), ? matches a single character
+func matchWildcard(pattern, s string) bool {
+	patternIdx, sIdx := 0, 0
+	starPatternIdx, starSIdx := -1, 0
+	for sIdx < len(s) {
+		switch {
+		case patternIdx < len(pattern) && pattern[patternIdx] == '*':
+			starPatternIdx = patternIdx
+			starSIdx = sIdx
+			patternIdx++
+		case patternIdx < len(pattern) && (pattern[patternIdx] == '?' || pattern[patternIdx] == s[sIdx]):
+			patternIdx++
+			sIdx++
+		case starPatternIdx != -1:
+			// let the last * match one more character
+			patternIdx = starPatternIdx + 1
+			starSIdx++
+			sIdx = starSIdx
+		default:
+			return false
+		}
+	}
+	for patternIdx < len(pattern) && pattern[patternIdx] == '*' {
+		patternIdx++
+	}
+	return patternIdx == len(pattern)
+}
+
+// checkCommandPolicy checks whether the request's client can run the command as the requested user,
+// and evaluates the command policy. If the command is denied the denial is logged and returned
+func checkCommandPolicy(r *http.Request, cmdToRun CommandModel) *PolicyDenialModel {
+	clientName := requestClientName(r)
+	denial := checkCommandIdentityAllowed(cmdToRun, clientName)
+	if denial == nil {
+		denial = serverCommandPolicyStore.Evaluate(cmdToRun, clientName)
+	}
+	if denial != nil {
+		log.Printf(" [!] Command denied by policy (client: %q, rule: %q): %s", clientName, denial.Rule, denial.Reason)
+	}
+	return denial
+}
+
+// policyDenialError - a command denied by the command policy
+type policyDenialError struct {
+	denial *PolicyDenialModel
+}
+
+func (e policyDenialError) Error() string {
+	return "Denied by policy: " + e.denial.Reason
+}
+
+// createPolicyDenialResponseModel ...
+func createPolicyDenialResponseModel(denial *PolicyDenialModel) ResponseModel {
+	resp := createErrorResponseModel(fmt.Sprintf("Denied by policy: %s", denial.Reason), 1)
+	resp.PolicyDenial = denial
+	return resp
+}
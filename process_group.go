@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var supportedSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"XCPU": syscall.SIGXCPU,
+}
+
+// ParseSignal ...
+// Accepts signal names with or without the SIG prefix (e.g. TERM, SIGTERM).
+func ParseSignal(name string) (syscall.Signal, error) {
+	sig, found := supportedSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !found {
+		return 0, fmt.Errorf("Unsupported signal: %s", name)
+	}
+	return sig, nil
+}
+
+// SignalName ...
+func SignalName(sig syscall.Signal) string {
+	for name, aSig := range supportedSignals {
+		if aSig == sig {
+			return "SIG" + name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// CommandProcessGroup ...
+// The command runs in its own process group, signals are sent to the whole group,
+// so processes started by the command are signaled too.
+// A signal sent before the command is started is delivered right after it starts.
+type CommandProcessGroup struct {
+	mu            sync.Mutex
+	pgid          int
+	isExited      bool
+	pendingSignal syscall.Signal
+}
+
+// Signal ...
+func (g *CommandProcessGroup) Signal(sig syscall.Signal) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.isExited {
+		return errors.New("Command already exited")
+	}
+	if g.pgid == 0 {
+		g.pendingSignal = sig
+		return nil
+	}
+	return syscall.Kill(-g.pgid, sig)
+}
+
+func (g *CommandProcessGroup) prepare(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// a new session means a new process group as well
+	if !c.SysProcAttr.Setsid {
+		c.SysProcAttr.Setpgid = true
+	}
+}
+
+func (g *CommandProcessGroup) started(pid int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pgid = pid
+	if g.pendingSignal != 0 {
+		return syscall.Kill(-g.pgid, g.pendingSignal)
+	}
+	return nil
+}
+
+func (g *CommandProcessGroup) exited() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.isExited = true
+}
+
+// terminatingSignal returns the signal which terminated the command, if it was terminated by one
+func terminatingSignal(err error) (syscall.Signal, bool) {
+	exitError, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	waitStatus, ok := exitError.Sys().(syscall.WaitStatus)
+	if !ok || !waitStatus.Signaled() {
+		return 0, false
+	}
+	return waitStatus.Signal(), true
+}
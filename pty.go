@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+var (
+	defaultTTYSize = TerminalSizeModel{Rows: 24, Cols: 80}
+
+	// configPTYOutputDrainTimeout - how long to wait for the remaining output once the command exited,
+	// processes started in the background might keep the pty open
+	configPTYOutputDrainTimeout = 2 * time.Second
+)
+
+// commandPTY ...
+type commandPTY struct {
+	master *os.File
+	slave  *os.File
+}
+
+func newCommandPTY(size TerminalSizeModel) (*commandPTY, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	if err := setTerminalSize(master, size); err != nil {
+		closeFiles(master, slave)
+		return nil, err
+	}
+	return &commandPTY{master: master, slave: slave}, nil
+}
+
+// Resize ...
+func (pty *commandPTY) Resize(size TerminalSizeModel) error {
+	return setTerminalSize(pty.master, size)
+}
+
+// Close ...
+// The slave is normally closed right after the command exited,
+// but it's still open if the command was never started.
+// The master might be closed already, if the command's output couldn't be drained.
+func (pty *commandPTY) Close() error {
+	if err := pty.slave.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		log.Println(" [!] Failed to close pty slave:", err)
+	}
+	if err := pty.master.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// ptyStdinWriter writes into the pty's master, closing it sends an EOF character (Ctrl-D)
+// instead of closing the terminal
+type ptyStdinWriter struct {
+	pty *commandPTY
+}
+
+func (w ptyStdinWriter) Write(p []byte) (int, error) {
+	return w.pty.master.Write(p)
+}
+
+func (w ptyStdinWriter) Close() error {
+	_, err := w.pty.master.Write([]byte{4})
+	return err
+}
+
+// runCommandInPTY runs the command in a new session, with the pty as its controlling terminal,
+// and copies the terminal's output into outputWriter. credential can be nil (the server's credentials).
+func runCommandInPTY(dirPath string, command string, cmdArgs []string, cmdEnvs []string, pty *commandPTY, outputWriter io.Writer, credential *syscall.Credential, processGroup *CommandProcessGroup) (int, error) {
+	outputDone := make(chan struct{})
+	go func() {
+		// returns an error (EIO on Linux) once every process closed the terminal
+		if _, err := io.Copy(outputWriter, pty.master); err != nil {
+			vLogln("pty output copy finished:", err)
+		}
+		close(outputDone)
+	}()
+
+	sysProcAttr := &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+		// Ctty is the child's stdin (the pty's slave)
+		Ctty:       0,
+		Credential: credential,
+	}
+	cmdExitCode, err := RunCommandInDirWithArgsEnvsAndWriters(dirPath, command, cmdArgs, cmdEnvs, pty.slave, pty.slave, pty.slave, sysProcAttr, processGroup)
+	if closeErr := pty.slave.Close(); closeErr != nil {
+		log.Println(" [!] Failed to close pty slave:", closeErr)
+	}
+
+	select {
+	case <-outputDone:
+	case <-time.After(configPTYOutputDrainTimeout):
+		log.Println(" (!) pty is still open after the command exited, not waiting for more output")
+		// outputWriter can't be written once this function returned, stop the copy and wait for it
+		if deadlineErr := pty.master.SetReadDeadline(time.Now()); deadlineErr != nil {
+			vLogln("Failed to set the pty's read deadline, closing it:", deadlineErr)
+			if closeErr := pty.master.Close(); closeErr != nil {
+				log.Println(" [!] Failed to close pty master:", closeErr)
+			}
+		}
+		<-outputDone
+	}
+	return cmdExitCode, err
+}
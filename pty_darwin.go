@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+// openPTY opens a new pseudo-terminal, returns its master and slave end
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ioctl(master, syscall.TIOCPTYGRANT, nil); err != nil {
+		closeFiles(master)
+		return nil, nil, fmt.Errorf("Failed to grant pty: %s", err)
+	}
+	if err := ioctl(master, syscall.TIOCPTYUNLK, nil); err != nil {
+		closeFiles(master)
+		return nil, nil, fmt.Errorf("Failed to unlock pty: %s", err)
+	}
+	nameBuf := make([]byte, 128)
+	if err := ioctl(master, syscall.TIOCPTYGNAME, unsafe.Pointer(&nameBuf[0])); err != nil {
+		closeFiles(master)
+		return nil, nil, fmt.Errorf("Failed to get pty name: %s", err)
+	}
+	slaveName := string(nameBuf[:bytes.IndexByte(nameBuf, 0)])
+
+	slave, err := os.OpenFile(slaveName, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		closeFiles(master)
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
+
+// openPTY opens a new pseudo-terminal, returns its master and slave end
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unlock := int32(0)
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		closeFiles(master)
+		return nil, nil, fmt.Errorf("Failed to unlock pty: %s", err)
+	}
+	var ptyNumber uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&ptyNumber)); err != nil {
+		closeFiles(master)
+		return nil, nil, fmt.Errorf("Failed to get pty number: %s", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNumber), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		closeFiles(master)
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
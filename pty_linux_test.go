@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ptyTestWriter collects the output, and records whether it was written after it was closed
+type ptyTestWriter struct {
+	mu                  sync.Mutex
+	buf                 bytes.Buffer
+	isClosed            bool
+	isWrittenAfterClose bool
+}
+
+func (w *ptyTestWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		w.isWrittenAfterClose = true
+	}
+	return w.buf.Write(p)
+}
+
+func (w *ptyTestWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.isClosed = true
+}
+
+func (w *ptyTestWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestOpenPTY(t *testing.T) {
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("Failed to open pty: %s", err)
+	}
+	defer closeFiles(master, slave)
+
+	if !isTerminal(slave) {
+		t.Fatal("The slave should be a terminal")
+	}
+	if _, err := slave.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Failed to write into the slave: %s", err)
+	}
+	buf := make([]byte, 64)
+	n, err := master.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read from the master: %s", err)
+	}
+	// the terminal translates the new line
+	if got := string(buf[:n]); got != "hello\r\n" {
+		t.Fatalf("Read %q from the master, want %q", got, "hello\r\n")
+	}
+}
+
+func TestCommandPTYResize(t *testing.T) {
+	pty, err := newCommandPTY(TerminalSizeModel{Rows: 40, Cols: 120})
+	if err != nil {
+		t.Fatalf("Failed to open pty: %s", err)
+	}
+	defer func() {
+		if err := pty.Close(); err != nil {
+			t.Errorf("Failed to close pty: %s", err)
+		}
+	}()
+
+	for _, aSize := range []TerminalSizeModel{{Rows: 40, Cols: 120}, {Rows: 50, Cols: 200}} {
+		if err := pty.Resize(aSize); err != nil {
+			t.Fatalf("Failed to resize pty: %s", err)
+		}
+		size, err := getTerminalSize(pty.slave)
+		if err != nil {
+			t.Fatalf("Failed to get terminal size: %s", err)
+		}
+		if size != aSize {
+			t.Fatalf("Terminal size: got %+v, want %+v", size, aSize)
+		}
+	}
+}
+
+func TestRunCommandInPTY(t *testing.T) {
+	pty, err := newCommandPTY(TerminalSizeModel{Rows: 30, Cols: 100})
+	if err != nil {
+		t.Fatalf("Failed to open pty: %s", err)
+	}
+	defer func() {
+		if err := pty.Close(); err != nil {
+			t.Errorf("Failed to close pty: %s", err)
+		}
+	}()
+
+	outputWriter := &ptyTestWriter{}
+	exitCode, err := runCommandInPTY("", "/bin/bash", []string{"-c", `test -t 0 && test -t 1 && echo is-tty; stty size; exit 3`},
+		[]string{"PATH=/usr/bin:/bin"}, pty, outputWriter, nil, &CommandProcessGroup{})
+	if err == nil || exitCode != 3 {
+		t.Fatalf("Got exit code %d (error: %v), want 3", exitCode, err)
+	}
+	output := outputWriter.String()
+	for _, aWant := range []string{"is-tty\r\n", "30 100\r\n"} {
+		if !strings.Contains(output, aWant) {
+			t.Errorf("Output should contain %q, got: %q", aWant, output)
+		}
+	}
+}
+
+func TestRunCommandInPTYDrainTimeout(t *testing.T) {
+	origDrainTimeout := configPTYOutputDrainTimeout
+	defer func() { configPTYOutputDrainTimeout = origDrainTimeout }()
+	configPTYOutputDrainTimeout = 100 * time.Millisecond
+
+	pty, err := newCommandPTY(defaultTTYSize)
+	if err != nil {
+		t.Fatalf("Failed to open pty: %s", err)
+	}
+	defer func() {
+		if err := pty.Close(); err != nil {
+			t.Errorf("Failed to close pty: %s", err)
+		}
+	}()
+
+	// the background process keeps the pty open, and writes into it after the command exited
+	// (it ignores the SIGHUP it gets when the session leader exits)
+	outputWriter := &ptyTestWriter{}
+	startTime := time.Now()
+	exitCode, err := runCommandInPTY("", "/bin/bash", []string{"-c", `trap "" HUP; echo started; (sleep 0.5; echo late) &`},
+		[]string{"PATH=/usr/bin:/bin"}, pty, outputWriter, nil, &CommandProcessGroup{})
+	outputWriter.Close()
+	if err != nil || exitCode != 0 {
+		t.Fatalf("Got exit code %d (error: %v), want 0", exitCode, err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 400*time.Millisecond {
+		t.Fatalf("Should return after the drain timeout, took: %s", elapsed)
+	}
+
+	// the background process' output
+	time.Sleep(time.Second)
+	outputWriter.mu.Lock()
+	defer outputWriter.mu.Unlock()
+	if outputWriter.isWrittenAfterClose {
+		t.Fatalf("The output was written after runCommandInPTY returned: %q", outputWriter.buf.String())
+	}
+	if !strings.Contains(outputWriter.buf.String(), "started") {
+		t.Fatalf("Output should contain the command's output, got: %q", outputWriter.buf.String())
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	sessionMessageTypeStart  = "start"
+	sessionMessageTypeStdin  = "stdin"
+	sessionMessageTypeEOF    = "eof"
+	sessionMessageTypeResize = "resize"
+	sessionMessageTypeSignal = "signal"
+)
+
+// configSessionStartTimeout - the client has to send the start message within this time
+var configSessionStartTimeout = 30 * time.Second
+
+// SessionMessageModel ...
+// A message sent by the client of an interactive session (/session WebSocket endpoint).
+// Types: "start" (the command to run, has to be the first message), "stdin" (data to write into
+// the command's stdin - binary messages are written into the stdin as they are), "eof" (closes the stdin),
+// "resize" (resizes the terminal, in tty mode) and "signal" (sends a signal to the command, e.g. INT).
+// The server sends the same frames a streamed /cmd response has (job, output, result),
+// one frame per (text) message, and closes the connection after the result.
+type SessionMessageModel struct {
+	Type    string        `json:"type"`
+	Command *CommandModel `json:"command,omitempty"`
+	Data    []byte        `json:"data,omitempty"`
+	Rows    uint16        `json:"rows,omitempty"`
+	Cols    uint16        `json:"cols,omitempty"`
+	Signal  string        `json:"signal,omitempty"`
+}
+
+// sessionHandler runs a command (or a login shell) as a job,
+// with its input and output carried over a WebSocket connection
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Println(" [!] Failed to start session:", err)
+		return
+	}
+	log.Println(" (i) Session started")
+	if clientName := requestClientName(r); clientName != "" {
+		log.Println(" (i) Client:", clientName)
+	}
+
+	streamEncoder := newFrameEncoder(websocketTextWriter{conn: conn})
+	job, stdinWriter, err := startSessionJob(r, conn, streamEncoder)
+	if err != nil {
+		log.Println(" [!] Session error:", err)
+		respModel := createErrorResponseModel(fmt.Sprintf("%s", err), 1)
+		failureReason := requestFailureInvalid
+		var denialErr policyDenialError
+		if errors.As(err, &denialErr) {
+			respModel = createPolicyDenialResponseModel(denialErr.denial)
+			failureReason = requestFailurePolicyDenied
+		} else if err == errJobQueueFull || err == errNoFreeSlot {
+			failureReason = requestFailureServerBusy
+		}
+		serverMetrics.CountRequestFailure(failureReason)
+		if err := respondWithStreamResult(streamEncoder, respModel); err != nil {
+			vLogln("Failed to send session result:", err)
+		}
+		if err := conn.Close(websocketCloseNormal, ""); err != nil {
+			log.Println(" [!] Failed to close session:", err)
+		}
+		return
+	}
+
+	go readSessionMessages(conn, job, stdinWriter)
+
+	<-job.Done()
+	if err := respondWithStreamResult(streamEncoder, job.Result()); err != nil {
+		log.Println(" [!] Failed to send session result:", err)
+	}
+	if err := conn.Close(websocketCloseNormal, ""); err != nil {
+		log.Println(" [!] Failed to close session:", err)
+	}
+	log.Printf(" (i) Session of job %s finished", job.ID)
+}
+
+// startSessionJob reads the start message, checks the command and submits the job
+func startSessionJob(r *http.Request, conn *websocketConn, streamEncoder *frameEncoder) (*Job, io.WriteCloser, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(configSessionStartTimeout)); err != nil {
+		return nil, nil, err
+	}
+	opcode, messageBytes, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read the start message: %s", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+
+	var message SessionMessageModel
+	if opcode != websocketOpText {
+		return nil, nil, errors.New("The first message has to be a start message")
+	}
+	if err := json.Unmarshal(messageBytes, &message); err != nil {
+		return nil, nil, fmt.Errorf("Invalid JSON: %s", err)
+	}
+	if message.Type != sessionMessageTypeStart || message.Command == nil {
+		return nil, nil, errors.New("The first message has to be a start message, with the command")
+	}
+
+	cmdToRun := *message.Command
+	if err := validateCommandModel(cmdToRun); err != nil {
+		return nil, nil, err
+	}
+	if denial := checkCommandPolicy(r, cmdToRun); denial != nil {
+		return nil, nil, policyDenialError{denial: denial}
+	}
+	// the session's input is always forwarded (in tty mode it's written into the terminal)
+	cmdToRun.Stdin = true
+	fmt.Printf("Session command to run: %#v\n", commandModelForLog(cmdToRun))
+
+	job, err := NewJob(cmdToRun, requestClientName(r), streamEncoder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create job: %s", err)
+	}
+	stdinWriter, err := job.TakeStdinWriter()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = serverJobManager.Submit(job, func() {
+		if err := streamEncoder.WriteFrame(StreamFrame{Type: streamFrameTypeJob, JobID: job.ID}); err != nil {
+			log.Println(" [!] Failed to send job frame: ", err)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return job, stdinWriter, nil
+}
+
+// readSessionMessages handles the client's messages until the connection is closed.
+// If the client disconnects while the command is still running the command gets a SIGHUP,
+// the same as if its terminal was closed.
+func readSessionMessages(conn *websocketConn, job *Job, stdinWriter io.WriteCloser) {
+	defer func() {
+		if err := stdinWriter.Close(); err != nil {
+			vLogln("Failed to close session stdin:", err)
+		}
+	}()
+
+	for {
+		opcode, messageBytes, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-job.Done():
+			default:
+				log.Printf(" (i) Job %s: session disconnected (%s)", job.ID, err)
+				if err := job.Cancel(syscall.SIGHUP); err != nil {
+					vLogln("Failed to send SIGHUP:", err)
+				}
+			}
+			return
+		}
+
+		if opcode == websocketOpBinary {
+			if _, err := stdinWriter.Write(messageBytes); err != nil {
+				log.Printf(" [!] Job %s: failed to write stdin: %s", job.ID, err)
+			}
+			continue
+		}
+
+		var message SessionMessageModel
+		if err := json.Unmarshal(messageBytes, &message); err != nil {
+			log.Printf(" [!] Job %s: invalid session message: %s", job.ID, err)
+			continue
+		}
+		switch message.Type {
+		case sessionMessageTypeStdin:
+			if _, err := stdinWriter.Write(message.Data); err != nil {
+				log.Printf(" [!] Job %s: failed to write stdin: %s", job.ID, err)
+			}
+		case sessionMessageTypeEOF:
+			if err := stdinWriter.Close(); err != nil {
+				log.Printf(" [!] Job %s: failed to close stdin: %s", job.ID, err)
+			}
+		case sessionMessageTypeResize:
+			if err := job.Resize(TerminalSizeModel{Rows: message.Rows, Cols: message.Cols}); err != nil {
+				log.Printf(" [!] Job %s: failed to resize: %s", job.ID, err)
+			}
+		case sessionMessageTypeSignal:
+			sig, err := ParseSignal(message.Signal)
+			if err != nil {
+				log.Printf(" [!] Job %s: %s", job.ID, err)
+				continue
+			}
+			if err := job.Signal(sig); err != nil {
+				log.Printf(" [!] Job %s: failed to send signal: %s", job.ID, err)
+			}
+		default:
+			log.Printf(" [!] Job %s: unknown session message type: %s", job.ID, message.Type)
+		}
+	}
+}
+
+//
+// --- non server mode
+
+// attachShellToServer runs the command (or a login shell, if the command is empty)
+// in a pseudo-terminal, in an interactive session: the local terminal is connected to the remote one
+func attachShellToServer(cmdToSend CommandModel) (cmdExCode int, cmdErr error) {
+	cmdToSend.TTY = true
+	if isTerminal(os.Stdout) {
+		if size, err := getTerminalSize(os.Stdout); err == nil {
+			cmdToSend.TTYSize = &size
+		}
+	}
+	vLogln(fmt.Sprintf("Starting session: %#v", commandModelForLog(cmdToSend)))
+
+	conn, err := dialWebSocket("/session")
+	if err != nil {
+		return 1, err
+	}
+	defer func() {
+		if err := conn.Close(websocketCloseNormal, ""); err != nil {
+			vLogln("Failed to close session:", err)
+		}
+	}()
+
+	sendMessage := func(message SessionMessageModel) error {
+		messageBytes, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocketOpText, messageBytes)
+	}
+	if err := sendMessage(SessionMessageModel{Type: sessionMessageTypeStart, Command: &cmdToSend}); err != nil {
+		return 1, err
+	}
+
+	if isTerminal(os.Stdin) {
+		oldState, err := makeTerminalRaw(os.Stdin)
+		if err != nil {
+			return 1, fmt.Errorf("Failed to switch the terminal to raw mode: %s", err)
+		}
+		defer func() {
+			if err := restoreTerminal(os.Stdin, oldState); err != nil {
+				log.Println(" [!] Failed to restore the terminal:", err)
+			}
+		}()
+	}
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if err := conn.WriteMessage(websocketOpBinary, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					if err := sendMessage(SessionMessageModel{Type: sessionMessageTypeEOF}); err != nil {
+						vLogln("Failed to send EOF:", err)
+					}
+				}
+				return
+			}
+		}
+	}()
+
+	// terminal size changes, and signals received by the client (e.g. if its stdin is not a terminal)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGWINCH {
+				size, err := getTerminalSize(os.Stdout)
+				if err != nil {
+					continue
+				}
+				err = sendMessage(SessionMessageModel{Type: sessionMessageTypeResize, Rows: size.Rows, Cols: size.Cols})
+				if err != nil {
+					vLogln("Failed to send terminal size:", err)
+				}
+				continue
+			}
+			if sysSig, ok := sig.(syscall.Signal); ok {
+				if err := sendMessage(SessionMessageModel{Type: sessionMessageTypeSignal, Signal: SignalName(sysSig)}); err != nil {
+					vLogln("Failed to send signal:", err)
+				}
+			}
+		}
+	}()
+
+	respModel, err := readStreamedResponse(&websocketMessageReader{conn: conn}, os.Stdout, os.Stderr, func(string) {})
+	if err != nil {
+		return 1, fmt.Errorf("Session failed: %s", err)
+	}
+	vLogf("respModel: %#v\n", respModel)
+	cmdExCode = respModel.ExitCode
+
+	if respModel.PolicyDenial != nil {
+		logPolicyDenial(respModel.PolicyDenial)
+	}
+
+	if respModel.Status != configOkStatusMsg {
+		return cmdExCode, fmt.Errorf("Server returned an error response: %#v", respModel)
+	}
+	if respModel.ExitCode != 0 {
+		return cmdExCode, fmt.Errorf("Bridged command exit code is not 0: %#v", respModel)
+	}
+	return cmdExCode, nil
+}
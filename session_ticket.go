@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// configSessionTicketTTL - a session ticket has to be used within this time
+var configSessionTicketTTL = 30 * time.Second
+
+// serverSessionTickets - the session tickets issued by the server, which are not yet used
+var serverSessionTickets = NewSessionTicketStore()
+
+// SessionTicketResponseModel ...
+// The response of POST /session/ticket.
+type SessionTicketResponseModel struct {
+	Ticket string `json:"ticket"`
+	// ExpiresIn - the ticket has to be used within this many seconds
+	ExpiresIn int `json:"expires_in"`
+}
+
+type sessionTicket struct {
+	clientName string
+	expiresAt  time.Time
+}
+
+// SessionTicketStore ...
+// Browsers can't set the Authorization header of a WebSocket request, so they open the
+// session with a ticket instead (/session?ticket=TICKET): a short-lived, single-use token,
+// issued to an authenticated client, which identifies the same client.
+type SessionTicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]sessionTicket
+}
+
+// NewSessionTicketStore ...
+func NewSessionTicketStore() *SessionTicketStore {
+	return &SessionTicketStore{tickets: map[string]sessionTicket{}}
+}
+
+// Issue returns a new ticket for the client, valid for configSessionTicketTTL
+func (store *SessionTicketStore) Issue(clientName string) (string, error) {
+	ticket, err := generateSessionTicket()
+	if err != nil {
+		return "", err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.removeExpired()
+	store.tickets[ticket] = sessionTicket{clientName: clientName, expiresAt: time.Now().Add(configSessionTicketTTL)}
+	return ticket, nil
+}
+
+// Redeem returns the name of the client the ticket was issued to, if the ticket is valid.
+// A ticket can only be redeemed once.
+func (store *SessionTicketStore) Redeem(ticket string) (string, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	aTicket, found := store.tickets[ticket]
+	if !found {
+		return "", false
+	}
+	delete(store.tickets, ticket)
+	if time.Now().After(aTicket.expiresAt) {
+		return "", false
+	}
+	return aTicket.clientName, true
+}
+
+func (store *SessionTicketStore) removeExpired() {
+	now := time.Now()
+	for aTicket, aSessionTicket := range store.tickets {
+		if now.After(aSessionTicket.expiresAt) {
+			delete(store.tickets, aTicket)
+		}
+	}
+}
+
+func generateSessionTicket() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionTicketHandler handles: POST /session/ticket - a ticket to open a session with, for browsers
+func sessionTicketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondWithError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method not allowed: %s", r.Method))
+		return
+	}
+
+	ticket, err := serverSessionTickets.Issue(requestClientName(r))
+	if err != nil {
+		log.Println(" [!] Failed to issue session ticket:", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to issue session ticket")
+		return
+	}
+	// not with respondWithJSONStatus, which would log the ticket
+	respModel := SessionTicketResponseModel{Ticket: ticket, ExpiresIn: int(configSessionTicketTTL / time.Second)}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(respModel); err != nil {
+		log.Println(" [!] Failed to send Response: ", err)
+	}
+}
+
+// requireSessionAuth wraps the session handler: the request is authenticated either
+// with a session ticket (ticket query parameter), or the same way as the other requests (requireAuth).
+// Requests from a not allowed origin are rejected first, so they can't use up a ticket.
+func requireSessionAuth(handler http.HandlerFunc) http.HandlerFunc {
+	authHandler := requireAuth(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAllowedWebSocketOrigin(r) {
+			log.Printf(" [!] Request from a not allowed origin (%s): %s %s", r.Header.Get("Origin"), r.Method, r.URL.Path)
+			respondWithError(w, http.StatusForbidden, "Origin not allowed")
+			return
+		}
+
+		ticket := r.URL.Query().Get("ticket")
+		if ticket == "" {
+			authHandler(w, r)
+			return
+		}
+
+		clientName, isValid := serverSessionTickets.Redeem(ticket)
+		if !isValid {
+			log.Printf(" [!] Unauthorized request from %s: %s %s (invalid or expired session ticket)", r.RemoteAddr, r.Method, r.URL.Path)
+			serverMetrics.CountAuthFailure()
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), clientNameContextKey, clientName)))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionTicketStore(t *testing.T) {
+	store := NewSessionTicketStore()
+
+	ticket, err := store.Issue("ci")
+	if err != nil {
+		t.Fatalf("Failed to issue ticket: %s", err)
+	}
+	if clientName, isValid := store.Redeem(ticket); !isValid || clientName != "ci" {
+		t.Fatalf("Redeem: got (%q, %v), want (\"ci\", true)", clientName, isValid)
+	}
+	if _, isValid := store.Redeem(ticket); isValid {
+		t.Fatal("A ticket should only be redeemable once")
+	}
+	if _, isValid := store.Redeem(""); isValid {
+		t.Fatal("An empty ticket should be invalid")
+	}
+
+	origTTL := configSessionTicketTTL
+	defer func() { configSessionTicketTTL = origTTL }()
+	configSessionTicketTTL = -time.Second
+	expiredTicket, err := store.Issue("ci")
+	if err != nil {
+		t.Fatalf("Failed to issue ticket: %s", err)
+	}
+	if _, isValid := store.Redeem(expiredTicket); isValid {
+		t.Fatal("An expired ticket should be invalid")
+	}
+}
+
+func TestRequireSessionAuth(t *testing.T) {
+	origTokenStore := serverAuthTokenStore
+	defer func() { serverAuthTokenStore = origTokenStore }()
+	tokenStore, err := NewAuthTokenStore("", "ci:ci-token")
+	if err != nil {
+		t.Fatalf("Failed to create token store: %s", err)
+	}
+	serverAuthTokenStore = tokenStore
+
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+	configServer.AllowedOrigins = []string{"https://terminal.example.com"}
+
+	ticket, err := serverSessionTickets.Issue("ci")
+	if err != nil {
+		t.Fatalf("Failed to issue ticket: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		url        string
+		token      string
+		origin     string
+		wantStatus int
+		wantClient string
+	}{
+		{name: "token", url: "/session", token: "ci-token", wantStatus: http.StatusOK, wantClient: "ci"},
+		{name: "not allowed origin", url: "/session?ticket=" + ticket, origin: "https://evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "no auth", url: "/session", wantStatus: http.StatusUnauthorized},
+		{name: "ticket", url: "/session?ticket=" + ticket, origin: "https://terminal.example.com", wantStatus: http.StatusOK, wantClient: "ci"},
+		{name: "used ticket", url: "/session?ticket=" + ticket, wantStatus: http.StatusUnauthorized},
+		{name: "invalid ticket", url: "/session?ticket=invalid", token: "ci-token", wantStatus: http.StatusUnauthorized},
+	} {
+		handlerClientName := ""
+		handler := requireSessionAuth(func(w http.ResponseWriter, r *http.Request) {
+			handlerClientName = requestClientName(r)
+		})
+
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.wantStatus)
+		}
+		if handlerClientName != tc.wantClient {
+			t.Errorf("%s: got client %q, want %q", tc.name, handlerClientName, tc.wantClient)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	streamContentType = "application/x-ndjson"
+
+	streamFrameTypeJob    = "job"
+	streamFrameTypeQueued = "queued"
+	streamFrameTypeOutput = "output"
+	streamFrameTypeResult = "result"
+)
+
+// StreamFrame ...
+// A streamed response is a sequence of newline delimited JSON frames:
+// a "job" frame (with the ID of the job running the command),
+// "queued" frames while the job waits for a free slot (whenever its queue position changes),
+// any number of "output" frames, followed by a single "result" frame.
+type StreamFrame struct {
+	Type          string         `json:"type"`
+	JobID         string         `json:"job_id,omitempty"`
+	QueuePosition int            `json:"queue_position,omitempty"`
+	Stream        string         `json:"stream,omitempty"`
+	Data          []byte         `json:"data,omitempty"`
+	Response      *ResponseModel `json:"response,omitempty"`
+}
+
+// frameEncoder serializes frames written from multiple goroutines
+// and flushes each one, so the client receives output as it's produced.
+// Once writing a frame failed (e.g. the client disconnected) every later write fails with the same error.
+type frameEncoder struct {
+	mu       sync.Mutex
+	encoder  *json.Encoder
+	flusher  http.Flusher
+	writeErr error
+}
+
+func newFrameEncoder(w io.Writer) *frameEncoder {
+	enc := &frameEncoder{encoder: json.NewEncoder(w)}
+	if flusher, ok := w.(http.Flusher); ok {
+		enc.flusher = flusher
+	}
+	return enc
+}
+
+func (e *frameEncoder) WriteFrame(frame StreamFrame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.writeErr != nil {
+		return e.writeErr
+	}
+	if err := e.encoder.Encode(&frame); err != nil {
+		e.writeErr = err
+		return err
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
+
+func (e *frameEncoder) err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.writeErr
+}
+
+// frameOutputWriter wraps every chunk written to it into an output frame of the given stream
+type frameOutputWriter struct {
+	enc    *frameEncoder
+	stream string
+}
+
+func (w frameOutputWriter) Write(p []byte) (int, error) {
+	if err := w.enc.WriteFrame(StreamFrame{Type: streamFrameTypeOutput, Stream: w.stream, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// streamOutputWriter writes the command's output into a response stream.
+// The client can disconnect while the command runs: after the first failed write
+// the rest of the output is dropped, but the write never fails, so the command
+// keeps running and its other writers (log files) still receive the whole output.
+type streamOutputWriter struct {
+	frameOutputWriter
+}
+
+func (w streamOutputWriter) Write(p []byte) (int, error) {
+	if w.enc.err() != nil {
+		return len(p), nil
+	}
+	if _, err := w.frameOutputWriter.Write(p); err != nil {
+		log.Println(" [!] Failed to stream the command's output, the rest of the output is not streamed:", err)
+	}
+	return len(p), nil
+}
+
+func isStreamRequested(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), streamContentType)
+}
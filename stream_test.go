@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the client disconnecting from a streamed response doesn't stop the command:
+// the job finishes successfully and its log has the whole output
+func TestStreamedCommandClientDisconnect(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+	configServer.LogDirectory = t.TempDir()
+
+	server := httptest.NewServer(http.HandlerFunc(commandHandler))
+	defer server.Close()
+
+	const lineCount = 20000
+	body, err := json.Marshal(CommandModel{
+		Command: fmt.Sprintf("echo started; sleep 1; for i in $(seq 1 %d); do echo \"line $i\"; done", lineCount),
+		Login:   new(bool),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", server.URL+"/cmd", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", streamContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+
+	// disconnect once the command started to write its output
+	jobID := ""
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var frame StreamFrame
+		if err := decoder.Decode(&frame); err != nil {
+			t.Fatalf("Failed to read frame: %s", err)
+		}
+		if frame.Type == streamFrameTypeJob {
+			jobID = frame.JobID
+		}
+		if frame.Type == streamFrameTypeOutput {
+			break
+		}
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	job, isFound := serverJobManager.Get(jobID)
+	if !isFound {
+		t.Fatalf("Job %q not found", jobID)
+	}
+	select {
+	case <-job.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatal("The job didn't finish")
+	}
+	if result := job.Result(); result.Status != configOkStatusMsg {
+		t.Errorf("The job failed: %s", result.Msg)
+	}
+
+	logBytes, err := ioutil.ReadFile(jobLogFilePath(jobID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(logBytes), "\n"), "\n")
+	if len(lines) != lineCount+1 {
+		t.Errorf("expected %d lines in the job log, got %d", lineCount+1, len(lines))
+	}
+	if lastLine := lines[len(lines)-1]; lastLine != fmt.Sprintf("line %d", lineCount) {
+		t.Errorf("unexpected last line of the job log: %q", lastLine)
+	}
+}
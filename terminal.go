@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// TerminalSizeModel ...
+type TerminalSizeModel struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+type terminalWinsize struct {
+	rows   uint16
+	cols   uint16
+	xPixel uint16
+	yPixel uint16
+}
+
+// ioctl ...
+// Through the file's SyscallConn, as f.Fd() would put the file into blocking mode:
+// its reads couldn't be interrupted (with a deadline or by closing it) anymore.
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func closeFiles(files ...*os.File) {
+	for _, aFile := range files {
+		if err := aFile.Close(); err != nil {
+			log.Println(" [!] Failed to close file:", err)
+		}
+	}
+}
+
+// isTerminal ...
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(f, ioctlGetTermios, unsafe.Pointer(&termios)) == nil
+}
+
+// getTerminalSize ...
+// Returns an error if the terminal's size is not set (0 rows or columns).
+func getTerminalSize(f *os.File) (TerminalSizeModel, error) {
+	var ws terminalWinsize
+	if err := ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return TerminalSizeModel{}, err
+	}
+	if ws.rows == 0 || ws.cols == 0 {
+		return TerminalSizeModel{}, errors.New("Terminal size is not set")
+	}
+	return TerminalSizeModel{Rows: ws.rows, Cols: ws.cols}, nil
+}
+
+// setTerminalSize ...
+// For a pty's master the foreground process group of the terminal gets a SIGWINCH.
+func setTerminalSize(f *os.File, size TerminalSizeModel) error {
+	ws := terminalWinsize{rows: size.Rows, cols: size.Cols}
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// makeTerminalRaw puts the terminal into raw mode (the same as cfmakeraw),
+// returns the previous state, which can be restored with restoreTerminal
+func makeTerminalRaw(f *os.File) (*syscall.Termios, error) {
+	var oldState syscall.Termios
+	if err := ioctl(f, ioctlGetTermios, unsafe.Pointer(&oldState)); err != nil {
+		return nil, err
+	}
+
+	newState := oldState
+	newState.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	newState.Oflag &^= syscall.OPOST
+	newState.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	newState.Cflag &^= syscall.CSIZE | syscall.PARENB
+	newState.Cflag |= syscall.CS8
+	newState.Cc[syscall.VMIN] = 1
+	newState.Cc[syscall.VTIME] = 0
+	if err := ioctl(f, ioctlSetTermios, unsafe.Pointer(&newState)); err != nil {
+		return nil, err
+	}
+	return &oldState, nil
+}
+
+// restoreTerminal ...
+func restoreTerminal(f *os.File, state *syscall.Termios) error {
+	return ioctl(f, ioctlSetTermios, unsafe.Pointer(state))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// serverHTTPClient is used (in non-server mode) to send requests to the server
+var serverHTTPClient = http.DefaultClient
+
+func loadCertPool(caCertPath string) (*x509.CertPool, error) {
+	caCertBytes, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA certificate(s): %s", err)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(caCertBytes) {
+		return nil, fmt.Errorf("No valid PEM certificate found in: %s", caCertPath)
+	}
+	return certPool, nil
+}
+
+// createServerTLSConfig returns nil if TLS is not enabled (no certificate specified).
+// If clientCAPath is specified clients have to present a certificate issued by one of those CAs.
+func createServerTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	if certPath == "" && keyPath == "" {
+		if clientCAPath != "" {
+			return nil, errors.New("Client certificate verification requires TLS: specify -tls-cert and -tls-key too")
+		}
+		return nil, nil
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, errors.New("Both -tls-cert and -tls-key have to be specified")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate / key: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAPath != "" {
+		clientCAs, err := loadCertPool(clientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// createClientHTTPClient returns http.DefaultClient if no TLS related option is specified
+func createClientHTTPClient(caCertPath, clientCertPath, clientKeyPath string) (*http.Client, error) {
+	if caCertPath == "" && clientCertPath == "" && clientKeyPath == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caCertPath != "" {
+		rootCAs, err := loadCertPool(caCertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if clientCertPath != "" || clientKeyPath != "" {
+		if clientCertPath == "" || clientKeyPath == "" {
+			return nil, errors.New("Both -client-cert and -client-key have to be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate / key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// clientCertificateName returns the common name of the client's verified certificate, if any
+func clientCertificateName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
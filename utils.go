@@ -1,27 +1,48 @@
 package main
 
 import (
-	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
-func makeTempFile(fName string) (*os.File, error) {
-	f, err := ioutil.TempFile(os.TempDir(), fName)
-	if err != nil {
-		return nil, err
+// envOrDefault returns the value of the environment variable, or defaultValue if it's not set
+func envOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-	return f, nil
+	return defaultValue
+}
+
+// normalizeListenAddress - an address without a host (only a port)
+// means listening on the loopback interface
+func normalizeListenAddress(address string) string {
+	if !strings.Contains(address, ":") {
+		return "127.0.0.1:" + address
+	}
+	return address
+}
+
+// stringListFlag is a flag which can be specified multiple times
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 func vLogln(s string, args ...interface{}) {
 	if ConfigIsVerboseLogMode {
-		log.Println(s, args)
+		log.Println(append([]interface{}{s}, args...)...)
 	}
 }
 
 func vLogf(s string, args ...interface{}) {
 	if ConfigIsVerboseLogMode {
-		log.Printf(s, args)
+		log.Printf(s, args...)
 	}
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The WebSocket protocol is implemented by github.com/gorilla/websocket,
+// websocketConn adds what the sessions need on top of it: writes from multiple goroutines,
+// and the close handshake.
+
+const (
+	websocketOpText   = websocket.TextMessage
+	websocketOpBinary = websocket.BinaryMessage
+
+	websocketCloseNormal = websocket.CloseNormalClosure
+)
+
+var (
+	// configWebSocketMaxMessageSize - larger messages are rejected
+	configWebSocketMaxMessageSize = 1 << 20
+	// configWebSocketHandshakeTimeout - the client's timeout for the WebSocket handshake
+	configWebSocketHandshakeTimeout = 30 * time.Second
+	// configWebSocketCloseTimeout - how long sending the close message can take
+	configWebSocketCloseTimeout = 5 * time.Second
+)
+
+var errWebSocketClosed = errors.New("WebSocket connection closed")
+
+// websocketConn ...
+// Messages can be written from multiple goroutines, but should only be read from one.
+type websocketConn struct {
+	conn *websocket.Conn
+
+	writeMu     sync.Mutex
+	isCloseSent bool
+}
+
+func newWebsocketConn(conn *websocket.Conn) *websocketConn {
+	conn.SetReadLimit(int64(configWebSocketMaxMessageSize))
+	return &websocketConn{conn: conn}
+}
+
+// upgradeWebSocket switches the request's connection to the WebSocket protocol.
+// If it fails an error response is already sent.
+// Browsers are only allowed to connect from the allowed_origins,
+// so other sites can't use the browser's credentials (e.g. its client certificate).
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: isAllowedWebSocketOrigin,
+		Error: func(w http.ResponseWriter, r *http.Request, statusCode int, reason error) {
+			respondWithError(w, statusCode, reason.Error())
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWebsocketConn(conn), nil
+}
+
+// isAllowedWebSocketOrigin - requests without an Origin are not sent by browsers.
+// The request's Host is not trusted (e.g. DNS rebinding), only the origins listed in allowed_origins are,
+// without allowed_origins every browser request is rejected.
+func isAllowedWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, anAllowedOrigin := range configServer.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(anAllowedOrigin, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAllowedOrigins - an origin is a scheme and a host (with an optional port), e.g. https://terminal.example.com
+func validateAllowedOrigins(origins []string) error {
+	for _, anOrigin := range origins {
+		originURL, err := url.Parse(anOrigin)
+		if err != nil || (originURL.Scheme != "http" && originURL.Scheme != "https") || originURL.Host == "" ||
+			strings.TrimSuffix(originURL.Path, "/") != "" || originURL.RawQuery != "" || originURL.User != nil {
+			return fmt.Errorf("invalid origin, expected SCHEME://HOST[:PORT], got: %s", anOrigin)
+		}
+	}
+	return nil
+}
+
+// dialWebSocket opens a WebSocket connection to the cmd-bridge server's path,
+// with the same TLS settings and auth token the other requests use
+func dialWebSocket(path string) (*websocketConn, error) {
+	req, err := newServerRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch req.URL.Scheme {
+	case "http":
+		req.URL.Scheme = "ws"
+	case "https":
+		req.URL.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("Unsupported server URL scheme: %s", req.URL.Scheme)
+	}
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: configWebSocketHandshakeTimeout,
+		TLSClientConfig:  &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	if transport, ok := serverHTTPClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		dialer.TLSClientConfig = transport.TLSClientConfig.Clone()
+	}
+
+	conn, resp, err := dialer.Dial(req.URL.String(), req.Header)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		// the body of the error response, the dialer reads (a part of) it
+		respBodyBytes, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, errors.New("The cmd-bridge server rejected the request: unauthorized - check the auth token (CMD_BRIDGE_TOKEN / -token-file)")
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("WebSocket upgrade failed (%d), and failed to read the response: %s", resp.StatusCode, readErr)
+		}
+		return nil, fmt.Errorf("WebSocket upgrade failed (%d): %s", resp.StatusCode, strings.TrimSpace(string(respBodyBytes)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newWebsocketConn(conn), nil
+}
+
+// ReadMessage ...
+// Returns the next text or binary message. Pings are answered, and if the other side
+// closes the connection the close is confirmed and errWebSocketClosed is returned.
+func (c *websocketConn) ReadMessage() (int, []byte, error) {
+	opcode, message, err := c.conn.ReadMessage()
+	if err != nil {
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return 0, nil, errWebSocketClosed
+		}
+		return 0, nil, err
+	}
+	return opcode, message, nil
+}
+
+// WriteMessage ...
+// Sends the payload as a single text or binary message.
+func (c *websocketConn) WriteMessage(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.isCloseSent {
+		return errWebSocketClosed
+	}
+	return c.conn.WriteMessage(opcode, payload)
+}
+
+// SetReadDeadline ...
+// A zero time means no deadline.
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Close ...
+// Sends a close message (if it's not yet sent) with the given status code,
+// and closes the connection.
+func (c *websocketConn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	isCloseSent := c.isCloseSent
+	c.isCloseSent = true
+	c.writeMu.Unlock()
+
+	if !isCloseSent {
+		closeMessage := websocket.FormatCloseMessage(code, reason)
+		if err := c.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(configWebSocketCloseTimeout)); err != nil && err != websocket.ErrCloseSent {
+			vLogln("Failed to send WebSocket close:", err)
+		}
+	}
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// websocketMessageReader reads the received text messages as a continuous stream,
+// e.g. to decode the stream frames with a json.Decoder
+type websocketMessageReader struct {
+	conn    *websocketConn
+	message []byte
+}
+
+func (r *websocketMessageReader) Read(p []byte) (int, error) {
+	for len(r.message) == 0 {
+		opcode, message, err := r.conn.ReadMessage()
+		if err == errWebSocketClosed {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if opcode == websocketOpText {
+			r.message = message
+		}
+	}
+	n := copy(p, r.message)
+	r.message = r.message[n:]
+	return n, nil
+}
+
+// websocketTextWriter sends every Write as a text message,
+// e.g. to send stream frames (one JSON per message) with a frameEncoder
+type websocketTextWriter struct {
+	conn *websocketConn
+}
+
+func (w websocketTextWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocketOpText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
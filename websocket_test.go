@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketOrigin(t *testing.T) {
+	origConfig := configServer
+	defer func() { configServer = origConfig }()
+	configServer = defaultServerConfig()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		// echo one message
+		if opcode, message, err := conn.ReadMessage(); err == nil {
+			if err := conn.WriteMessage(opcode, message); err != nil {
+				t.Errorf("Failed to write message: %s", err)
+			}
+		}
+		if err := conn.Close(websocketCloseNormal, ""); err != nil {
+			t.Errorf("Failed to close connection: %s", err)
+		}
+	}))
+	defer server.Close()
+	serverURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, tc := range []struct {
+		name           string
+		allowedOrigins []string
+		origin         string
+		wantAllowed    bool
+	}{
+		{name: "not a browser", origin: "", wantAllowed: true},
+		{name: "no allowed origins", origin: server.URL, wantAllowed: false},
+		{name: "allowed", allowedOrigins: []string{"https://terminal.example.com/"}, origin: "https://terminal.example.com", wantAllowed: true},
+		{name: "other origin", allowedOrigins: []string{"https://terminal.example.com"}, origin: "https://evil.example.com", wantAllowed: false},
+		{name: "other scheme", allowedOrigins: []string{"https://terminal.example.com"}, origin: "http://terminal.example.com", wantAllowed: false},
+	} {
+		configServer.AllowedOrigins = tc.allowedOrigins
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+
+		conn, resp, err := websocket.DefaultDialer.Dial(serverURL, header)
+		if !tc.wantAllowed {
+			if err == nil {
+				if err := conn.Close(); err != nil {
+					t.Errorf("%s: failed to close connection: %s", tc.name, err)
+				}
+				t.Errorf("%s: connection should be rejected", tc.name)
+			} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s: should be rejected with 403, got: %s", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to connect: %s", tc.name, err)
+			continue
+		}
+
+		wsConn := newWebsocketConn(conn)
+		if err := wsConn.WriteMessage(websocketOpText, []byte("hello")); err != nil {
+			t.Errorf("%s: failed to write message: %s", tc.name, err)
+		}
+		if _, message, err := wsConn.ReadMessage(); err != nil || string(message) != "hello" {
+			t.Errorf("%s: got (%q, %v), want the echoed message", tc.name, message, err)
+		}
+		if _, _, err := wsConn.ReadMessage(); err != errWebSocketClosed {
+			t.Errorf("%s: got %v, want errWebSocketClosed", tc.name, err)
+		}
+		if err := wsConn.Close(websocketCloseNormal, ""); err != nil {
+			t.Errorf("%s: failed to close connection: %s", tc.name, err)
+		}
+	}
+}
+
+func TestValidateAllowedOrigins(t *testing.T) {
+	for _, tc := range []struct {
+		origin  string
+		wantErr bool
+	}{
+		{origin: "https://terminal.example.com", wantErr: false},
+		{origin: "http://localhost:8080/", wantErr: false},
+		{origin: "terminal.example.com", wantErr: true},
+		{origin: "https://terminal.example.com/path", wantErr: true},
+		{origin: "ftp://terminal.example.com", wantErr: true},
+		{origin: "https://", wantErr: true},
+	} {
+		err := validateAllowedOrigins([]string{tc.origin})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got error %v, want error: %v", tc.origin, err, tc.wantErr)
+		}
+	}
+}